@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/guregu/bbs"
+	"github.com/guregu/relay/eti"
+	"github.com/guregu/relay/fourchan"
+)
+
+// gateway is a backend set up from a site's config, ready to mount.
+type gateway struct {
+	new func() bbs.BBS
+	// reach is like new, but for a copy of the site advertising a different realtime URL
+	reach func(realtimeURL string) func() bbs.BBS
+	// extra websocket endpoints, relative to the site's path
+	handlers map[string]http.Handler
+	// health returns an error if the site's upstream or cache is in trouble
+	health func() error
+	// close lets go of the site's resources once it's no longer served (can be nil)
+	close func()
+}
+
+// backend sets up a gateway from a site's config.
+// realtimeURL is where the site's websocket will be.
+type backend func(sc sitecfg, realtimeURL string) (gateway, error)
+
+// backends by site type
+var backends = map[string]backend{
+	"eti":        setupETI,
+	"fourchan":   setupFourchan,
+	"imageboard": setupImageboard,
+}
+
+func setupETI(sc sitecfg, realtimeURL string) (gateway, error) {
+	site := eti.NewSite()
+	sc.hello(&site.Hello, realtimeURL)
+	if sc.DangerTags != nil {
+		site.DangerTags = sc.DangerTags
+	}
+	site.SharedTags = sc.SharedTags
+	if sc.Cache {
+		c, err := sharedThreadCache()
+		if err != nil {
+			return gateway{}, err
+		}
+		site.UseCache(c)
+		site.Freshness = currentConfig().Cache.TTL.freshness()
+		if sc.Hello.Lists == nil {
+			site.Hello.Lists = append(site.Hello.Lists, "search")
+		}
+	}
+	return gateway{
+		new: site.New,
+		reach: func(realtimeURL string) func() bbs.BBS {
+			return site.WithRealtimeURL(realtimeURL).New
+		},
+		health: site.Healthy,
+	}, nil
+}
+
+func setupFourchan(sc sitecfg, realtimeURL string) (gateway, error) {
+	if sc.Flavor != "" && sc.Flavor != "4chan" {
+		return gateway{}, errors.New("fourchan sites are always the 4chan flavor; use type = \"imageboard\"")
+	}
+	sc.Flavor = "4chan"
+	return setupImageboard(sc, realtimeURL)
+}
+
+func setupImageboard(sc sitecfg, realtimeURL string) (gateway, error) {
+	site, err := fourchan.NewSite(sc.Flavor, sc.API, sc.Images, sc.Static)
+	if err != nil {
+		return gateway{}, err
+	}
+	sc.hello(&site.Hello, realtimeURL)
+	site.Limit(sc.RateLimit, sc.Burst)
+	if sc.Cache {
+		cc := currentConfig().Cache
+		persist := cc.kind() == "mongo"
+		if persist {
+			fourchan.DBConnect(cc.Addr, "fourchan")
+		}
+		site.EnableCache(persist)
+	}
+	return gateway{
+		new: site.New,
+		reach: func(realtimeURL string) func() bbs.BBS {
+			return site.WithRealtimeURL(realtimeURL).New
+		},
+		handlers: map[string]http.Handler{
+			"/watch": site.WatchHandler(),
+		},
+		health: site.Healthy,
+		close:  site.Close,
+	}, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/guregu/relay/eti"
+	"github.com/guregu/relay/logger"
+)
+
+// how often we look for expired threads
+const expireInterval = 1 * time.Hour
+
+// threadCache is shared by every ETI site with cache = true.
+// It's opened by the first one and lasts until shutdown: changing [cache] needs a restart.
+var threadCache eti.ThreadCache
+
+// closed to stop expireThreads, nil if it isn't running
+var expiring chan struct{}
+
+// sharedThreadCache opens the thread cache described by [cache], if it isn't open already,
+// and starts expiring old threads from it if [cache] says to.
+func sharedThreadCache() (eti.ThreadCache, error) {
+	cc := currentConfig().Cache
+	var maxAge time.Duration
+	if cc.Expire != "" {
+		var err error
+		if maxAge, err = time.ParseDuration(cc.Expire); err != nil {
+			return nil, err
+		}
+	}
+
+	if threadCache == nil {
+		var c eti.ThreadCache
+		var err error
+		switch cc.kind() {
+		case "mongo":
+			c, err = eti.NewMongoCache(cc.Addr, "eti")
+		case "bolt":
+			c, err = eti.NewBoltCache(cc.Path)
+		case "memory":
+			c = eti.NewMemoryCache(cc.Size)
+		case "":
+			return nil, errors.New("cache is on, but [cache] isn't set up")
+		default:
+			return nil, errors.New("unknown cache type: " + cc.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		threadCache = c
+	}
+
+	if maxAge > 0 && expiring == nil {
+		expiring = make(chan struct{})
+		go expireThreads(threadCache, maxAge, expiring)
+	}
+	return threadCache, nil
+}
+
+// stopExpiring stops expireThreads, if it's running.
+// It's started again by the next sharedThreadCache.
+func stopExpiring() {
+	if expiring != nil {
+		close(expiring)
+		expiring = nil
+	}
+}
+
+// usesThreadCache returns true if any of these sites use the thread cache.
+func usesThreadCache(relays []relay) bool {
+	for _, r := range relays {
+		if r.cfg.Type == "eti" && r.cfg.Cache {
+			return true
+		}
+	}
+	return false
+}
+
+// expireThreads drops old threads from c every so often, until stop is closed.
+func expireThreads(c eti.ThreadCache, maxAge time.Duration, stop chan struct{}) {
+	for {
+		n, err := eti.Expire(c, time.Now().Add(-maxAge))
+		if err != nil {
+			logger.Warn("couldn't expire threads", "error", err)
+		} else if n > 0 {
+			logger.Info("expired threads", "count", n, "max_age", maxAge)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(expireInterval):
+		}
+	}
+}
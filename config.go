@@ -1,17 +1,39 @@
 package main
 
-import "github.com/BurntSushi/toml"
+import (
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/guregu/bbs"
+	"github.com/guregu/relay/eti"
+	"github.com/guregu/relay/logger"
+)
 
 type config struct {
-	Server   servercfg
-	Web      webcfg
-	Cache    cachecfg
+	Server servercfg
+	Web    webcfg
+	Cache  cachecfg
+	Log    logcfg
+	Sites  []sitecfg `toml:"site"`
+
+	// old style [fourchan] and [eti] sections, still supported
 	FourChan sitecfg
 	ETI      sitecfg
 }
 
 type servercfg struct {
 	Host string
+
+	// serve HTTPS with this certificate and key (PEM files)
+	Cert string
+	Key  string
+	// or make up a certificate, for development
+	SelfSigned bool `toml:"selfsigned"`
+
+	// proxies (IPs or CIDRs) whose Forwarded/X-Forwarded-* headers we believe
+	// when telling clients where our websockets are
+	TrustedProxies []string `toml:"trusted_proxies"`
 }
 
 type webcfg struct {
@@ -20,18 +42,168 @@ type webcfg struct {
 }
 
 type sitecfg struct {
+	Type        string // backend: eti, fourchan, or imageboard
 	Path        string
 	Name        string
 	Description string
 	Enabled     bool
 	Cache       bool
+
+	// requests per second to the upstream site, and how many can burst at once
+	RateLimit float64
+	Burst     int
+
+	// overrides for anything in the site's hello message
+	Hello hellocfg
+
+	// for imageboards: which software the site runs (4chan, vichan)
+	Flavor string
+	// base URLs, to use a mirror or mock server instead of the real site
+	API    string
+	Images string
+	Static string
+
+	// for eti: tags whose threads are never cached (blank for the defaults),
+	// and tags anyone can read, whose cached threads skip the access check.
+	// Patterns like "*(social)" work.
+	DangerTags []string `toml:"danger_tags"`
+	SharedTags []string `toml:"shared_tags"`
+}
+
+// hellocfg overrides a site's bbs.HelloMessage. Anything left out stays as the backend's default.
+type hellocfg struct {
+	Name            string
+	Description     string
+	ProtocolVersion *int `toml:"protocol_version"`
+	Icon            string
+	Options         []string
+	Formats         []string
+	Lists           []string
+	ServerVersion   string   `toml:"server_version"`
+	DefaultRange    []int    `toml:"default_range"` // [start, end]
+	RealtimeURL     string   `toml:"realtime"`
+	GuestCommands   []string `toml:"guest_commands"`
+	UserCommands    []string `toml:"user_commands"`
+}
+
+// apply overrides the parts of h this config sets.
+func (hc hellocfg) apply(h *bbs.HelloMessage) {
+	h.Name = maybe(hc.Name, h.Name)
+	h.Description = maybe(hc.Description, h.Description)
+	if hc.ProtocolVersion != nil {
+		h.ProtocolVersion = *hc.ProtocolVersion
+	}
+	h.IconURL = maybe(hc.Icon, h.IconURL)
+	if hc.Options != nil {
+		h.Options = hc.Options
+	}
+	if hc.Formats != nil {
+		h.Formats = hc.Formats
+	}
+	if hc.Lists != nil {
+		h.Lists = hc.Lists
+	}
+	h.ServerVersion = maybe(hc.ServerVersion, h.ServerVersion)
+	if len(hc.DefaultRange) == 2 {
+		h.DefaultRange = bbs.Range{Start: hc.DefaultRange[0], End: hc.DefaultRange[1]}
+	}
+	h.RealtimeURL = maybe(hc.RealtimeURL, h.RealtimeURL)
+	if hc.GuestCommands != nil {
+		h.Access.GuestCommands = hc.GuestCommands
+	}
+	if hc.UserCommands != nil {
+		h.Access.UserCommands = hc.UserCommands
+	}
 }
 
 type cachecfg struct {
-	Addr string
+	// where ETI threads are kept: mongo, bolt (a file on disk) or memory.
+	// Blank means mongo if addr is set.
+	Type string
+	Addr string // mongo server, also used for imageboard responses
+	Path string // bolt file
+	Size int    // how many threads memory keeps
+	// drop threads that haven't been updated in this long, like "720h" (blank for never)
+	Expire string
+	TTL    ttlcfg
+}
+
+// ttlcfg is how long cached ETI thread details are good for, like "10m" ("0" for forever).
+// Blank means the default.
+type ttlcfg struct {
+	Metadata string // title, tags, closed/archived state
+	Messages string
+}
+
+// freshness is the cache policy for ETI sites. It assumes the config has been validated.
+func (tc ttlcfg) freshness() eti.Freshness {
+	f := eti.DefaultFreshness
+	if d, err := time.ParseDuration(tc.Metadata); err == nil {
+		f.Metadata = d
+	}
+	if d, err := time.ParseDuration(tc.Messages); err == nil {
+		f.Messages = d
+	}
+	return f
+}
+
+// kind is the type of thread cache, or blank if there isn't one.
+func (cc cachecfg) kind() string {
+	if cc.Type == "" && cc.Addr != "" {
+		return "mongo"
+	}
+	return strings.ToLower(cc.Type)
+}
+
+type logcfg struct {
+	Format string // logfmt (default) or json
+	Level  string // debug, info (default), warn or error
+}
+
+// apply sets up logging. Anything invalid falls back to the default (validate will complain about it).
+func (lc logcfg) apply() {
+	format, err := logger.ParseFormat(lc.Format)
+	if err != nil {
+		format = logger.Logfmt
+	}
+	level, err := logger.ParseLevel(lc.Level)
+	if err != nil {
+		level = logger.InfoLevel
+	}
+	logger.Configure(format, level)
 }
 
 func parseConfig(file string) (cfg config, err error) {
 	_, err = toml.DecodeFile(file, &cfg)
 	return cfg, err
 }
+
+// hello sets up a site's hello message from its config.
+// The old style top level name and description still work, but [site.hello] wins.
+func (sc sitecfg) hello(h *bbs.HelloMessage, realtimeURL string) {
+	h.Name = maybe(sc.Name, h.Name)
+	h.Description = maybe(sc.Description, h.Description)
+	h.RealtimeURL = realtimeURL
+	sc.Hello.apply(h)
+}
+
+// path is where the site is served, /type by default
+func (sc sitecfg) path() string {
+	return maybe(sc.Path, "/"+sc.Type)
+}
+
+// sites returns every configured site, including the old style sections.
+func (cfg config) sites() []sitecfg {
+	var sites []sitecfg
+	if cfg.ETI.Enabled {
+		sc := cfg.ETI
+		sc.Type = "eti"
+		sites = append(sites, sc)
+	}
+	if cfg.FourChan.Enabled {
+		sc := cfg.FourChan
+		sc.Type = "fourchan"
+		sites = append(sites, sc)
+	}
+	return append(sites, cfg.Sites...)
+}
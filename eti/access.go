@@ -0,0 +1,168 @@
+package eti
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cached threads are shared by everyone on the relay, but not everyone on ETI can see every thread:
+// some boards are private. So a cached thread remembers who ETI has shown it to (and who it wouldn't),
+// and anyone else has to get past ETI once before we'll serve it to them.
+// Boards work the same way: once ETI has shown someone a thread, they can read every board it's tagged with,
+// so they can also see other cached threads that only have those boards' tags.
+// What we know gets forgotten when the thread's metadata goes stale, in case people lost access since.
+
+// DefaultDangerTags are tags whose threads are never cached: moderation talk and private social boards.
+var DefaultDangerTags = []string{"TCF", "TCF Lite", "Moderations", "*(social)"}
+
+// accessKey is where a user goes in CachedThread.Access.
+func accessKey(user string) string {
+	return "user:" + strings.ToLower(user)
+}
+
+// allow records whether ETI lets user see this thread.
+func (md *CachedThread) allow(user string, ok bool) {
+	if md.Access == nil {
+		md.Access = make(map[string]bool)
+	}
+	md.Access[accessKey(user)] = ok
+}
+
+// boardAccess remembers which boards (tags) ETI has let each user into.
+type boardAccess struct {
+	mu    sync.Mutex
+	users map[string]map[string]time.Time // accessKey(user) → tag → when ETI last showed them a thread with it
+}
+
+func newBoardAccess() *boardAccess {
+	return &boardAccess{users: make(map[string]map[string]time.Time)}
+}
+
+// let records that ETI just showed user a thread with these tags.
+func (b *boardAccess) let(user string, tags []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := accessKey(user)
+	boards, ok := b.users[key]
+	if !ok {
+		boards = make(map[string]time.Time)
+		b.users[key] = boards
+	}
+	now := time.Now()
+	for _, tag := range tags {
+		boards[tag] = now
+	}
+}
+
+// forget records that ETI turned user away from a thread with these tags.
+// We can't tell which board did it, so we forget them all.
+func (b *boardAccess) forget(user string, tags []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	boards := b.users[accessKey(user)]
+	for _, tag := range tags {
+		delete(boards, tag)
+	}
+}
+
+// canRead is true if ETI has let user into every one of these boards, within ttl (zero means forever).
+func (b *boardAccess) canRead(user string, tags []string, ttl time.Duration) bool {
+	if len(tags) == 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	boards := b.users[accessKey(user)]
+	for _, tag := range tags {
+		when, ok := boards[tag]
+		if !ok || stale(ttl, false, when) {
+			return false
+		}
+	}
+	return true
+}
+
+// dangerous returns the first of these tags that matches one of the site's danger tags.
+func (s *Site) dangerous(tags []string) (string, bool) {
+	for _, tag := range tags {
+		if matchTag(s.DangerTags, tag) {
+			return tag, true
+		}
+	}
+	return "", false
+}
+
+// shared is true if every one of these tags is one anyone can read.
+func (s *Site) shared(tags []string) bool {
+	if len(tags) == 0 {
+		return false
+	}
+	for _, tag := range tags {
+		if !matchTag(s.SharedTags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// canSee says whether user may see a cached thread, and whether we know either way.
+func (s *Site) canSee(md *CachedThread, user string) (ok, known bool) {
+	return s.allowed(md.Access, md.Thread.Tags, user)
+}
+
+// allowed says whether user may see a thread with this access list and these tags, and whether we know either way.
+func (s *Site) allowed(access map[string]bool, tags []string, user string) (ok, known bool) {
+	if ok, known := access[accessKey(user)]; known {
+		return ok, true
+	}
+	if s.shared(tags) || s.boards.canRead(user, tags, s.Freshness.Metadata) {
+		return true, true
+	}
+	return false, false
+}
+
+// granted records that ETI showed this session's user a thread.
+func (client *ETI) granted(md *CachedThread) {
+	md.allow(client.Username, true)
+	client.site.boards.let(client.Username, md.Thread.Tags)
+}
+
+// checkAccess makes sure this session's user can see a thread,
+// asking ETI if we don't know. Asking refreshes the thread's metadata too.
+func (client *ETI) checkAccess(md *CachedThread) error {
+	ok, known := client.site.canSee(md, client.Username)
+	switch {
+	case known && ok:
+		return nil
+	case known:
+		return accessDeniedError
+	}
+
+	fetch, err := client.fetchMetadata(md.ID)
+	switch err {
+	case nil:
+		md.refreshMetadata(fetch)
+		client.granted(md)
+		return nil
+	case accessDeniedError:
+		log.Info("access denied to cached thread", "thread", md.ID, "user", client.Username)
+		client.site.boards.forget(client.Username, md.Thread.Tags)
+		denied := *md
+		denied.Access = nil
+		denied.allow(client.Username, false)
+		client.site.saveThread(denied)
+	}
+	return err
+}
+
+// matchTag is true if a tag matches any of these patterns, like "LUE" or "*(social)".
+func matchTag(patterns []string, tag string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package eti
+
+import (
+	"testing"
+	"time"
+
+	"github.com/guregu/bbs"
+)
+
+func TestBoardAccess(t *testing.T) {
+	b := newBoardAccess()
+	b.let("Alice", []string{"LUE", "Private"})
+	b.let("bob", []string{"LUE"})
+
+	tests := []struct {
+		user string
+		tags []string
+		want bool
+	}{
+		{"alice", []string{"LUE"}, true},
+		{"alice", []string{"LUE", "Private"}, true},
+		{"bob", []string{"LUE", "Private"}, false},
+		{"bob", []string{"Private"}, false},
+		{"carol", []string{"LUE"}, false},
+		// no tags, no board to have been let into
+		{"alice", nil, false},
+	}
+	for _, test := range tests {
+		if got := b.canRead(test.user, test.tags, time.Hour); got != test.want {
+			t.Errorf("canRead(%s, %v) = %v, want %v", test.user, test.tags, got, test.want)
+		}
+	}
+
+	// it's forgotten once it's stale
+	b.users[accessKey("bob")]["LUE"] = time.Now().Add(-2 * time.Hour)
+	if b.canRead("bob", []string{"LUE"}, time.Hour) {
+		t.Error("stale board access was trusted")
+	}
+	if !b.canRead("bob", []string{"LUE"}, 0) {
+		t.Error("board access should last forever with no ttl")
+	}
+
+	// turned away from a thread: we don't know which board it was
+	b.forget("alice", []string{"Private", "Other"})
+	if b.canRead("alice", []string{"Private"}, time.Hour) || !b.canRead("alice", []string{"LUE"}, time.Hour) {
+		t.Error("forget should only drop the thread's boards")
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	site := NewSite()
+	site.SharedTags = []string{"LUE"}
+	site.boards.let("alice", []string{"Pets"})
+	md := &CachedThread{Thread: bbs.ThreadMessage{Tags: []string{"Pets"}}}
+
+	if ok, known := site.canSee(md, "alice"); !ok || !known {
+		t.Errorf("alice (let into Pets) = %v, %v; want allowed", ok, known)
+	}
+	if _, known := site.canSee(md, "bob"); known {
+		t.Error("bob hasn't been let into Pets, so we shouldn't know")
+	}
+	// what ETI said about this thread beats what we know about its board
+	md.allow("alice", false)
+	if ok, known := site.canSee(md, "alice"); ok || !known {
+		t.Errorf("alice (denied this thread) = %v, %v; want denied", ok, known)
+	}
+}
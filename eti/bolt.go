@@ -0,0 +1,105 @@
+package eti
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var threadsBucket = []byte("threads")
+
+// boltCache keeps threads in a file on disk, as JSON.
+type boltCache struct {
+	db *bolt.DB
+}
+
+// NewBoltCache opens (or creates) a thread cache in the file at path.
+func NewBoltCache(path string) (ThreadCache, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(threadsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	log.Info("opened cache", "path", path)
+	return &boltCache{db: db}, nil
+}
+
+func (c *boltCache) Get(id string) (*CachedThread, error) {
+	var t *CachedThread
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(threadsBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNotCached
+		}
+		return json.Unmarshal(data, &t)
+	})
+	return t, err
+}
+
+func (c *boltCache) Upsert(t CachedThread) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(threadsBucket).Put([]byte(t.ID), data)
+	})
+}
+
+func (c *boltCache) Delete(id string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(threadsBucket).Delete([]byte(id))
+	})
+}
+
+func (c *boltCache) List() ([]string, error) {
+	var ids []string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(threadsBucket).ForEach(func(k, v []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids, err
+}
+
+func (c *boltCache) Expire(before time.Time) (int, error) {
+	removed := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(threadsBucket)
+		// can't delete while iterating
+		var old [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var t struct {
+				Updated time.Time
+			}
+			if err := json.Unmarshal(v, &t); err != nil || t.Updated.Before(before) {
+				old = append(old, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(old)
+		return nil
+	})
+	return removed, err
+}
+
+func (c *boltCache) Close() error {
+	return c.db.Close()
+}
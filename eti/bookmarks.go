@@ -1,12 +1,12 @@
 package eti
 
 import (
-	"log"
 	"strings"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/guregu/bbs"
+	"github.com/guregu/relay/metrics"
 	"github.com/pmylund/go-cache"
 )
 
@@ -39,11 +39,11 @@ func findBookmarks(username string, doc *goquery.Document) []bbs.Bookmark {
 
 func getBookmarks(username string) []bbs.Bookmark {
 	bookmarks, ok := bookmarkCache.Get(username)
+	metrics.Hit("eti_bookmarks", ok)
 	if !ok {
-		log.Println("no cache bookmark " + username)
+		log.Debug("bookmarks not cached", "user", username)
 		return nil
 	}
-	log.Println("cache bookmark :) " + username)
 	return bookmarks.([]bbs.Bookmark)
 }
 
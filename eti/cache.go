@@ -0,0 +1,51 @@
+package eti
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ThreadCache keeps threads we've fetched, so we don't have to fetch them again.
+// Implementations must be safe for concurrent use.
+type ThreadCache interface {
+	// Get returns a cached thread, or ErrNotCached.
+	Get(id string) (*CachedThread, error)
+	// Upsert saves a thread, replacing any cached version of it.
+	Upsert(t CachedThread) error
+	Delete(id string) error
+	// List returns the IDs of every cached thread.
+	List() ([]string, error)
+	// Expire removes threads that haven't been updated since before, returning how many it removed.
+	Expire(before time.Time) (int, error)
+	Close() error
+}
+
+// ErrNotCached is returned by ThreadCache.Get for threads that aren't in the cache.
+var ErrNotCached = errors.New("thread not cached")
+
+// cache writes in progress, so Flush can wait for them
+var writes sync.WaitGroup
+
+// UseCache makes this site cache threads in c, and lets its sessions search them.
+// Sites can share a cache.
+func (s *Site) UseCache(c ThreadCache) {
+	s.cache = c
+	s.index = indexFor(c)
+}
+
+// Flush waits for pending cache writes.
+func Flush() {
+	writes.Wait()
+}
+
+// Healthy returns an error if we can't reach the cache.
+// Without a cache there's nothing to check, since ETI requests need a logged in user.
+func (s *Site) Healthy() error {
+	if p, ok := s.cache.(interface {
+		Ping() error
+	}); ok {
+		return p.Ping()
+	}
+	return nil
+}
@@ -5,17 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"code.google.com/p/cookiejar"
 	"code.google.com/p/go.net/html"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/guregu/bbs"
+	"github.com/guregu/relay/logger"
+	"github.com/guregu/relay/metrics"
 )
 
 const ETITopicsPerPage = 50.0
@@ -34,44 +36,95 @@ const loginPageTitle = "Das Ende des Internets"
 var AllPosts = bbs.Range{1, 5000}
 var DefaultRange = bbs.Range{1, 50}
 
+var log = logger.With("backend", "eti")
+
 var topicIDExtractor = regexp.MustCompile(`<script type="text\/javascript">onDOMContentLoaded\(function\(\){new QuickPost\(([0-9]+),`)
 
-var Hello = bbs.HelloMessage{
-	Command:         "hello",
-	Name:            "ETI Relay",
-	ProtocolVersion: 0,
-	Description:     "End of the Internet -> BBS Relay",
-	Options:         []string{"tags", "avatars", "usertitles", "filter", "signatures", "range", "bookmarks"},
-	Access: bbs.AccessInfo{
-		GuestCommands: []string{"hello", "login", "logout"},
-		UserCommands:  []string{"get", "list", "post", "reply", "info"},
-	},
-	Formats:       []string{"html", "text"},
-	Lists:         []string{"thread", "bookmark"},
-	ServerVersion: "eti-relay 0.2",
-	IconURL:       "/static/eti.png",
-	DefaultRange:  DefaultRange,
+// DefaultHello returns the Hello ETI sites start out with.
+func DefaultHello() bbs.HelloMessage {
+	return bbs.HelloMessage{
+		Command:         "hello",
+		Name:            "ETI Relay",
+		ProtocolVersion: 0,
+		Description:     "End of the Internet -> BBS Relay",
+		Options:         []string{"tags", "avatars", "usertitles", "filter", "signatures", "range", "bookmarks", "refresh"},
+		Access: bbs.AccessInfo{
+			GuestCommands: []string{"hello", "login", "logout"},
+			UserCommands:  []string{"get", "list", "post", "reply", "info"},
+		},
+		Formats:       []string{"html", "text"},
+		Lists:         []string{"thread", "bookmark"},
+		ServerVersion: "eti-relay 0.2",
+		IconURL:       "/static/eti.png",
+		DefaultRange:  DefaultRange,
+	}
+}
+
+// Site is an ETI gateway. Every session on a site shares its Hello.
+type Site struct {
+	// Hello is what this site's sessions say hello with.
+	// Change it before serving.
+	Hello bbs.HelloMessage
+
+	// how long cached threads are good for
+	Freshness Freshness
+
+	// DangerTags are tags whose threads are never cached.
+	// SharedTags are tags anyone on ETI can read:
+	// cached threads with only these tags are served to everyone without asking ETI first.
+	// Both can be patterns, like "*(social)".
+	DangerTags []string
+	SharedTags []string
+
+	cache   ThreadCache  // nil for no caching
+	index   *searchIndex // of cache
+	fetches *flightGroup // threads being loaded right now
+	boards  *boardAccess // who ETI has let into which boards
+}
+
+// NewSite creates an ETI gateway with the default Hello.
+func NewSite() *Site {
+	return &Site{
+		Hello:      DefaultHello(),
+		Freshness:  DefaultFreshness,
+		DangerTags: append([]string(nil), DefaultDangerTags...),
+		fetches:    newFlightGroup(),
+		boards:     newBoardAccess(),
+	}
+}
+
+// New is this site's bbs.BBS factory, for bbs.NewServer.
+func (s *Site) New() bbs.BBS {
+	return &ETI{site: s}
 }
 
-func Setup(name, desc, realtimePath string) {
-	Hello.Name = maybe(name, "ETI")
-	Hello.Description = maybe(desc, "ETI Gateway")
-	Hello.RealtimeURL = realtimePath
+// WithRealtimeURL returns a copy of the site that advertises a different realtime URL.
+// Everything else is shared with the original.
+func (s *Site) WithRealtimeURL(url string) *Site {
+	cp := *s
+	cp.Hello.RealtimeURL = url
+	return &cp
+}
+
+// defaultRange is how many posts we get when a client doesn't ask for a range.
+func (s *Site) defaultRange() bbs.Range {
+	if s.Hello.DefaultRange.Empty() {
+		return DefaultRange
+	}
+	return s.Hello.DefaultRange
 }
 
 type ETI struct {
 	HTTPClient *http.Client
 	Username   string
 
+	site     *Site
 	loggedIn bool
 }
 
-func New() bbs.BBS {
-	return new(ETI)
-}
-
 func (eti *ETI) grab(url string) (*goquery.Document, error) {
-	log.Printf("Getting: [%s] %s", eti.Username, url)
+	log.Debug("fetching", "user", eti.Username, "url", url)
+	seen(eti.Username)
 	r, err := eti.HTTPClient.Get(url)
 	defer r.Body.Close()
 	if err != nil {
@@ -82,7 +135,8 @@ func (eti *ETI) grab(url string) (*goquery.Document, error) {
 
 // grabAjax gets one of those ajaxed }"html goes here" docs
 func (eti *ETI) grabAjax(url string) (*goquery.Document, error) {
-	log.Printf("Getting: [%s] %s", eti.Username, url)
+	log.Debug("fetching", "user", eti.Username, "url", url)
+	seen(eti.Username)
 	r, err := eti.HTTPClient.Get(url)
 	if err != nil {
 		return nil, err
@@ -105,7 +159,7 @@ func (eti *ETI) grabAjax(url string) (*goquery.Document, error) {
 }
 
 func (eti *ETI) Hello() bbs.HelloMessage {
-	return Hello
+	return eti.site.Hello
 }
 
 func (eti *ETI) Register(m bbs.RegisterCommand) (okm bbs.OKMessage, err error) {
@@ -117,14 +171,14 @@ func (eti *ETI) IsLoggedIn() bool {
 	return eti.loggedIn
 }
 
-func (eti *ETI) fetchMetadata(id string) (metadata, error) {
+func (eti *ETI) fetchMetadata(id string) (CachedThread, error) {
 	url := threadURL + id
 	doc, err := eti.grab(url)
 	if err != nil {
-		return metadata{}, err
+		return CachedThread{}, err
 	}
 
-	md := metadata{
+	md := CachedThread{
 		ID: id,
 		Thread: bbs.ThreadMessage{
 			Command: "msg",
@@ -135,17 +189,17 @@ func (eti *ETI) fetchMetadata(id string) (metadata, error) {
 
 	// is ETI even ok?
 	// if len(doc.Find(".body").Nodes) == 0 {
-	// 	return metadata{}, serverIsDownError
+	// 	return CachedThread{}, serverIsDownError
 	// }
 
 	// did we get logged out?
 	if doc.Find("title").Text() == loginPageTitle {
-		return metadata{}, sessionError
+		return CachedThread{}, sessionError
 	}
 
 	// can we even look at this thread?
 	if doc.Find(".body > em").Text() == "You are not authorized to view messages on this board." {
-		return metadata{}, accessDeniedError
+		return CachedThread{}, accessDeniedError
 	}
 
 	// topic title
@@ -168,14 +222,15 @@ func (eti *ETI) fetchMetadata(id string) (metadata, error) {
 	// get the last page and estimate the # of posts
 	lastPage, err := strconv.Atoi(doc.Find("#u0_2 > span:first-child").Text())
 	if err != nil {
-		return metadata{}, errors.New("parsing - latspage")
+		return CachedThread{}, errors.New("parsing - latspage")
 	}
 	md.pages, md.Thread.Total = lastPage, lastPage*50
+	md.MetadataFetched = time.Now()
 
 	return md, nil
 }
 
-func (eti *ETI) fetchArchivedMsgs(md metadata) (*goquery.Selection, error) {
+func (eti *ETI) fetchArchivedMsgs(md CachedThread) (*goquery.Selection, error) {
 	var msgs *goquery.Selection
 	urls, err := threadURLs(md.Thread.ID, bbs.Range{1, md.Thread.Total}, true)
 	if err != nil {
@@ -214,41 +269,52 @@ func (eti *ETI) fetchArchivedMsgs(md metadata) (*goquery.Selection, error) {
 	return msgs, nil
 }
 
-func (client *ETI) Get(m bbs.GetCommand) (t bbs.ThreadMessage, err error) {
-	if !client.IsLoggedIn() {
-		return bbs.ThreadMessage{}, errors.New("session")
-	}
-
-	var reqRange = m.Range
-	if reqRange.Empty() {
-		reqRange = DefaultRange
-	} else {
-		if !reqRange.Validate() {
-			err = errors.New(fmt.Sprintf("Invalid range (%v)", m.Range))
-			return
-		}
-	}
-	// tokens have precent over range for now
-	// I don't think they should be together anyway
-	if m.Token != "" {
-		if r, ok := parseToken(m.Token); ok {
-			reqRange = r
-		}
-	}
+// loadedThread is a thread as loadThread left it.
+type loadedThread struct {
+	md       *CachedThread
+	complete bool // we just got every message
+	danger   bool // it has things we can't cache or share, like mod notes
+}
 
+// loadThread gets a thread from the cache, or from ETI if it isn't cached or is stale.
+// Unless it's cached, we get every message.
+func (client *ETI) loadThread(id string, refresh bool) (loadedThread, error) {
 	// see if we can get the cached version
 	// TODO: formatting
 
-	md := getThread(m.ThreadID)
-	if md == nil {
-		fetch, err := client.fetchMetadata(m.ThreadID)
+	fresh := client.site.Freshness
+	md := client.site.getThread(id)
+	switch {
+	case md == nil:
+		fetch, err := client.fetchMetadata(id)
 		if err != nil {
-			return bbs.ThreadMessage{}, err
+			return loadedThread{}, err
 		}
 		md = &fetch
+		client.granted(md)
+	case refresh || fresh.staleMetadata(md):
+		fetch, err := client.fetchMetadata(id)
+		if err == accessDeniedError {
+			client.site.boards.forget(client.Username, md.Thread.Tags)
+		}
+		if err != nil {
+			return loadedThread{}, err
+		}
+		md.refreshMetadata(fetch)
+		// start over on who can see it, too
+		md.Access = nil
+		client.granted(md)
+	default:
+		if err := client.checkAccess(md); err != nil {
+			return loadedThread{}, err
+		}
+	}
+	if refresh || fresh.staleMessages(md) {
+		// get them all again below
+		md.Thread.Messages = nil
 	}
 
-	danger := false // can we cache this thread without leaking stuff?
+	lt := loadedThread{md: md}
 	// if we haven't fetched any messages yet
 	if len(md.Thread.Messages) == 0 {
 		var msgs *goquery.Selection
@@ -256,20 +322,20 @@ func (client *ETI) Get(m bbs.GetCommand) (t bbs.ThreadMessage, err error) {
 			var err error
 			msgs, err = client.fetchArchivedMsgs(*md)
 			if err != nil {
-				return bbs.ThreadMessage{}, err
+				return loadedThread{}, err
 			}
 		} else {
 			// get the whole fkn thread
 			doc, err := client.grabAjax(fmt.Sprintf(
-				"http://boards.endoftheinter.net/moremessages.php?topic=%s&old=0&new=6666&filter=0", m.ThreadID))
+				"http://boards.endoftheinter.net/moremessages.php?topic=%s&old=0&new=6666&filter=0", id))
 			if err != nil {
-				return bbs.ThreadMessage{}, err
+				return loadedThread{}, err
 			}
 			msgs = doc.Find(".message-container")
 
 			// did we get logged out?
 			if doc.Find("title").Text() == loginPageTitle {
-				return bbs.ThreadMessage{}, sessionError
+				return loadedThread{}, sessionError
 			}
 		}
 
@@ -277,26 +343,70 @@ func (client *ETI) Get(m bbs.GetCommand) (t bbs.ThreadMessage, err error) {
 
 		// TODO: bbshtmlify
 		md.Thread.Messages = parseMessages(msgs, "html")
+		md.MessagesFetched = time.Now()
 		md.Thread.Total = len(md.Thread.Messages)
 		md.Thread.Range = bbs.Range{1, md.Thread.Total}
+		lt.complete = true
 
 		if msgs.Find(".secret").Size() == 0 {
 			// don't cache mod notes
-			go updateThread(*md)
+			client.site.saveThread(*md)
 		} else {
-			danger = true
+			lt.danger = true
 		}
+	}
+	return lt, nil
+}
 
-		if reqRange.Start > len(md.Thread.Messages) {
-			// since we just got the whole thread we know this request will be empty
-			t = md.Thread
-			t.Range = reqRange
-			t.Messages = []bbs.Message{}
-			t.More = false
-			t.NextToken = strconv.Itoa(len(md.Thread.Messages))
-			return t, nil
+func (client *ETI) Get(m bbs.GetCommand) (t bbs.ThreadMessage, err error) {
+	if !client.IsLoggedIn() {
+		return bbs.ThreadMessage{}, errors.New("session")
+	}
+
+	var reqRange = m.Range
+	if reqRange.Empty() {
+		reqRange = client.site.defaultRange()
+	} else {
+		if !reqRange.Validate() {
+			err = errors.New(fmt.Sprintf("Invalid range (%v)", m.Range))
+			return
 		}
 	}
+	// tokens have precent over range for now
+	// I don't think they should be together anyway
+	if m.Token != "" {
+		if r, ok := parseToken(m.Token, client.site.defaultRange()); ok {
+			reqRange = r
+		}
+	}
+
+	// concurrent gets of the same thread on this site share a fetch
+	// refreshes skip the cache, so they only share with each other
+	key := m.ThreadID
+	if m.Refresh {
+		key += " refresh"
+	}
+	lt, err := client.site.fetches.do(key, func() (loadedThread, error) {
+		return client.loadThread(m.ThreadID, m.Refresh)
+	})
+	if err != nil {
+		return bbs.ThreadMessage{}, err
+	}
+	md, danger := lt.md, lt.danger
+	// someone else might have loaded it
+	if err := client.checkAccess(md); err != nil {
+		return bbs.ThreadMessage{}, err
+	}
+
+	if lt.complete && reqRange.Start > len(md.Thread.Messages) {
+		// since we just got the whole thread we know this request will be empty
+		t = md.Thread
+		t.Range = reqRange
+		t.Messages = []bbs.Message{}
+		t.More = false
+		t.NextToken = strconv.Itoa(len(md.Thread.Messages))
+		return t, nil
+	}
 
 	if reqRange.End > len(md.Thread.Messages) {
 		doc, err := client.grabAjax(fmt.Sprintf(
@@ -319,7 +429,7 @@ func (client *ETI) Get(m bbs.GetCommand) (t bbs.ThreadMessage, err error) {
 	}
 
 	if !danger {
-		go updateThread(*md)
+		client.site.saveThread(*md)
 	}
 
 	t = md.Thread
@@ -349,6 +459,10 @@ func (client *ETI) List(m bbs.ListCommand) (ret bbs.ListMessage, err error) {
 		return bbs.ListMessage{}, errors.New("session")
 	}
 
+	if m.Type == "search" {
+		return client.search(m.Query)
+	}
+
 	query := m.Query
 	data := getURLData(client.HTTPClient, topicsURL+query)
 	doc := stringToDocument(data)
@@ -362,8 +476,7 @@ func (client *ETI) List(m bbs.ListCommand) (ret bbs.ListMessage, err error) {
 	ohs := doc.Find("tr")
 
 	if ohs.Size() == 0 {
-		fmt.Println("----- FUCK -----")
-		fmt.Println(data)
+		log.Warn("no topics found", "user", client.Username, "query", query, "page_size", len(data))
 		return bbs.ListMessage{}, errors.New("No results: " + query)
 	}
 
@@ -457,7 +570,7 @@ func (eti *ETI) LogIn(m bbs.LoginCommand) bool {
 	username := m.Username
 	password := m.Password
 	jar, _ := cookiejar.New(nil)
-	c := &http.Client{nil, nil, jar}
+	c := &http.Client{Transport: metrics.Transport{}, Jar: jar}
 	resp, _ := c.PostForm(loginURL, url.Values{
 		"username": {username},
 		"password": {password},
@@ -470,16 +583,21 @@ func (eti *ETI) LogIn(m bbs.LoginCommand) bool {
 		eti.loggedIn = true
 		eti.HTTPClient = c
 		eti.Username = username
+		seen(username)
 
-		log.Println("logged in", eti.Username)
+		log.Info("logged in", "user", eti.Username)
 	} else {
 		eti.loggedIn = false
+		log.Info("login failed", "user", username)
 	}
 	return eti.loggedIn
 }
 
 func (eti *ETI) LogOut(m bbs.LogoutCommand) bbs.OKMessage {
 	//ok sure
+	if eti.loggedIn {
+		activeUsers.Delete(eti.Username)
+	}
 	eti.loggedIn = false
 	return bbs.OKMessage{"ok", "logout", ""}
 }
@@ -530,13 +648,12 @@ func (client *ETI) Post(m bbs.PostCommand) (okm bbs.OKMessage, err error) {
 	} else if resp.StatusCode == 302 {
 		// seems like this doesn't get called anymore :(
 		ret := strings.Split(resp.Header.Get("Location"), "?topic=")[1]
-		fmt.Println("AHHH", ret)
+		log.Debug("posted topic (redirect)", "user", client.Username, "topic", ret)
 		return bbs.OKMessage{"ok", "post", ret}, nil
 	} else {
+		log.Warn("couldn't post topic", "user", client.Username, "status", resp.StatusCode)
 		return bbs.OKMessage{}, errors.New("Maybe ETI is down?")
 	}
-	fmt.Println(resp.StatusCode)
-	return
 }
 
 func (client *ETI) Reply(m bbs.ReplyCommand) (okm bbs.OKMessage, err error) {
@@ -590,7 +707,7 @@ func (client *ETI) Reply(m bbs.ReplyCommand) (okm bbs.OKMessage, err error) {
 }
 
 func getURLData(client *http.Client, url string) string {
-	fmt.Println("getting:", url)
+	log.Debug("fetching", "url", url)
 	resp, e := client.Get(url)
 	if e != nil {
 		return "error"
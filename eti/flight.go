@@ -0,0 +1,58 @@
+package eti
+
+import "sync"
+
+// flightGroup makes sure only one load of a thread happens at a time.
+// Everyone who asks for a thread while it's loading waits for that load to finish.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flight)}
+}
+
+// flight is a load that is in progress or finished.
+type flight struct {
+	wg  sync.WaitGroup
+	lt  loadedThread
+	err error
+}
+
+// do loads a thread with fn, unless someone else is already loading it.
+// Everyone gets their own copy of the thread.
+func (g *flightGroup) do(key string, fn func() (loadedThread, error)) (loadedThread, error) {
+	g.mu.Lock()
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		f.wg.Wait()
+		if f.err != nil || f.lt.danger {
+			// their load is no good to us: it failed (maybe they got logged out),
+			// or it has things only they can see
+			return fn()
+		}
+		return f.lt.copy(), nil
+	}
+	f := new(flight)
+	f.wg.Add(1)
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	f.lt, f.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	f.wg.Done()
+
+	if f.err != nil {
+		return loadedThread{}, f.err
+	}
+	return f.lt.copy(), nil
+}
+
+func (lt loadedThread) copy() loadedThread {
+	lt.md = lt.md.clone()
+	return lt
+}
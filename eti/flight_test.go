@@ -0,0 +1,132 @@
+package eti
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/guregu/bbs"
+)
+
+// race runs n calls of g.do(key, fn) at once, with the first one starting a moment before the others
+// so they all join it. It returns what each call got.
+func race(g *flightGroup, n int, fn func() (loadedThread, error)) ([]loadedThread, []error) {
+	lts := make([]loadedThread, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lts[i], errs[i] = g.do("1", fn)
+		}(i)
+		if i == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+	return lts, errs
+}
+
+// slowLoad is a load that takes long enough for everyone to join it, counting how many times it ran.
+func slowLoad(calls *int32, lt loadedThread, err error) func() (loadedThread, error) {
+	return func() (loadedThread, error) {
+		atomic.AddInt32(calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		got := lt
+		if got.md != nil {
+			got.md = got.md.clone()
+		}
+		return got, err
+	}
+}
+
+func TestFlightShares(t *testing.T) {
+	g := newFlightGroup()
+	var calls int32
+	md := &CachedThread{ID: "1", Thread: bbs.ThreadMessage{Messages: msgs("1:a")}}
+	lts, errs := race(g, 5, slowLoad(&calls, loadedThread{md: md, complete: true}, nil))
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("loaded %d times, want 1", n)
+	}
+	for i, lt := range lts {
+		if errs[i] != nil {
+			t.Errorf("#%d: %v", i, errs[i])
+			continue
+		}
+		if !lt.complete || len(lt.md.Thread.Messages) != 1 {
+			t.Errorf("#%d got %+v", i, lt)
+		}
+	}
+
+	// everyone gets their own copy
+	lts[0].md.Thread.Messages[0].Text = "changed"
+	lts[0].md.Thread.Messages = append(lts[0].md.Thread.Messages, bbs.Message{ID: "2"})
+	for i, lt := range lts[1:] {
+		if lt.md.Thread.Messages[0].Text != "a" || len(lt.md.Thread.Messages) != 1 {
+			t.Errorf("#%d shares messages with #0: %v", i+1, lt.md.Thread.Messages)
+		}
+	}
+}
+
+func TestFlightErrors(t *testing.T) {
+	g := newFlightGroup()
+	var calls int32
+	failed := errors.New("logged out")
+	_, errs := race(g, 3, slowLoad(&calls, loadedThread{}, failed))
+
+	// the first load failed, so the others tried for themselves
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("loaded %d times, want 3", n)
+	}
+	for i, err := range errs {
+		if err != failed {
+			t.Errorf("#%d: error = %v, want %v", i, err, failed)
+		}
+	}
+	if len(g.calls) != 0 {
+		t.Errorf("%d flights left over", len(g.calls))
+	}
+}
+
+func TestFlightDanger(t *testing.T) {
+	g := newFlightGroup()
+	var calls int32
+	md := &CachedThread{ID: "1"}
+	lts, errs := race(g, 3, slowLoad(&calls, loadedThread{md: md, danger: true}, nil))
+
+	// mod notes aren't shared, so everyone loads their own
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("loaded %d times, want 3", n)
+	}
+	for i, lt := range lts {
+		if errs[i] != nil || !lt.danger {
+			t.Errorf("#%d got %+v, %v", i, lt, errs[i])
+		}
+	}
+}
+
+func TestFlightAgain(t *testing.T) {
+	g := newFlightGroup()
+	var calls int32
+	load := slowLoad(&calls, loadedThread{md: &CachedThread{ID: "1"}}, nil)
+	g.do("1", load)
+	g.do("1", load)
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("loaded %d times, want 2: finished loads shouldn't be reused", n)
+	}
+}
+
+func TestFlightPerSite(t *testing.T) {
+	a, b := NewSite(), NewSite()
+	if a.fetches == b.fetches {
+		t.Error("two sites share loads, but they have their own caches and logins")
+	}
+	// the same site on another path is still the same site
+	if ws := a.WithRealtimeURL("/ws"); ws.fetches != a.fetches {
+		t.Error("a site's copy doesn't share its loads")
+	}
+}
@@ -0,0 +1,112 @@
+package eti
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DefaultMemoryCacheSize is how many threads a memory cache keeps if you don't say.
+const DefaultMemoryCacheSize = 1000
+
+// lruCache keeps the most recently used threads in memory.
+type lruCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List               // most recently used at the front
+	items map[string]*list.Element // id → element holding a *CachedThread
+	evict func(id string)          // called with every thread we forget to make room, if set
+}
+
+// NewMemoryCache creates a cache that keeps up to size threads in memory, forgetting the least recently used.
+func NewMemoryCache(size int) ThreadCache {
+	if size <= 0 {
+		size = DefaultMemoryCacheSize
+	}
+	return &lruCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache) Get(id string) (*CachedThread, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[id]
+	if !ok {
+		return nil, ErrNotCached
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*CachedThread).clone(), nil
+}
+
+func (c *lruCache) Upsert(t CachedThread) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[t.ID]; ok {
+		e.Value = t.clone()
+		c.order.MoveToFront(e)
+		return nil
+	}
+	c.items[t.ID] = c.order.PushFront(t.clone())
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.remove(oldest)
+		if c.evict != nil {
+			c.evict(oldest.Value.(*CachedThread).ID)
+		}
+	}
+	return nil
+}
+
+func (c *lruCache) Delete(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[id]; ok {
+		c.remove(e)
+	}
+	return nil
+}
+
+func (c *lruCache) List() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]string, 0, len(c.items))
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		ids = append(ids, e.Value.(*CachedThread).ID)
+	}
+	return ids, nil
+}
+
+func (c *lruCache) Expire(before time.Time) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*CachedThread).Updated.Before(before) {
+			c.remove(e)
+			removed++
+		}
+		e = next
+	}
+	return removed, nil
+}
+
+func (c *lruCache) Close() error {
+	return nil
+}
+
+// onEvict sets a function to be called with the ID of every thread the cache forgets to make room.
+func (c *lruCache) onEvict(f func(id string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict = f
+}
+
+// remove drops an element. c.mu must be held.
+func (c *lruCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.items, e.Value.(*CachedThread).ID)
+}
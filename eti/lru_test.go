@@ -0,0 +1,122 @@
+package eti
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/guregu/bbs"
+)
+
+func TestLRUEvicts(t *testing.T) {
+	c := NewMemoryCache(2)
+	c.Upsert(CachedThread{ID: "1"})
+	c.Upsert(CachedThread{ID: "2"})
+	c.Get("1") // 2 is now the least recently used
+	c.Upsert(CachedThread{ID: "3"})
+
+	if _, err := c.Get("2"); err != ErrNotCached {
+		t.Errorf("2 should have been evicted, got error %v", err)
+	}
+	for _, id := range []string{"1", "3"} {
+		if _, err := c.Get(id); err != nil {
+			t.Errorf("%s: %v", id, err)
+		}
+	}
+	ids, _ := c.List()
+	if want := []string{"3", "1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("List() = %v, want %v", ids, want)
+	}
+}
+
+func TestLRUUpsertReplaces(t *testing.T) {
+	c := NewMemoryCache(2)
+	c.Upsert(CachedThread{ID: "1", Thread: bbs.ThreadMessage{Title: "old"}})
+	c.Upsert(CachedThread{ID: "2"})
+	c.Upsert(CachedThread{ID: "1", Thread: bbs.ThreadMessage{Title: "new"}})
+	c.Upsert(CachedThread{ID: "3"}) // evicts 2, since upserting 1 used it
+
+	md, err := c.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Thread.Title != "new" {
+		t.Errorf("title = %q, want %q", md.Thread.Title, "new")
+	}
+	if _, err := c.Get("2"); err != ErrNotCached {
+		t.Errorf("2 should have been evicted, got error %v", err)
+	}
+}
+
+func TestLRUCopies(t *testing.T) {
+	c := NewMemoryCache(1)
+	md := CachedThread{
+		ID:     "1",
+		Thread: bbs.ThreadMessage{Messages: []bbs.Message{{ID: "a", Text: "hi"}}},
+		Access: map[string]bool{"alice": true},
+	}
+	c.Upsert(md)
+	md.Thread.Messages[0].Text = "changed"
+	md.Access["bob"] = true
+
+	got, _ := c.Get("1")
+	got.Thread.Messages[0].Text = "changed again"
+	got.Access["carol"] = true
+
+	got, _ = c.Get("1")
+	if got.Thread.Messages[0].Text != "hi" {
+		t.Errorf("text = %q, want %q", got.Thread.Messages[0].Text, "hi")
+	}
+	if len(got.Access) != 1 {
+		t.Errorf("access = %v, want only alice", got.Access)
+	}
+}
+
+func TestLRUExpireAndDelete(t *testing.T) {
+	c := NewMemoryCache(10)
+	now := time.Now()
+	c.Upsert(CachedThread{ID: "old", Updated: now.Add(-2 * time.Hour)})
+	c.Upsert(CachedThread{ID: "new", Updated: now})
+	c.Upsert(CachedThread{ID: "gone", Updated: now})
+
+	n, err := c.Expire(now.Add(-time.Hour))
+	if err != nil || n != 1 {
+		t.Errorf("Expire = %d, %v; want 1", n, err)
+	}
+	c.Delete("gone")
+	c.Delete("never there")
+
+	ids, _ := c.List()
+	if want := []string{"new"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("List() = %v, want %v", ids, want)
+	}
+}
+
+func TestLRUConcurrent(t *testing.T) {
+	c := NewMemoryCache(8)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := strconv.Itoa((i + j) % 16)
+				c.Upsert(CachedThread{ID: id, Updated: time.Now()})
+				c.Get(id)
+				c.List()
+				if j%10 == 0 {
+					c.Delete(id)
+					c.Expire(time.Now().Add(-time.Hour))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ids, _ := c.List()
+	if len(ids) > 8 {
+		t.Errorf("%d threads cached, want at most 8", len(ids))
+	}
+}
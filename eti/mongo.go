@@ -0,0 +1,86 @@
+package eti
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const mongoDialTimeout = 10 * time.Second
+
+// mongoCache keeps threads in MongoDB.
+type mongoCache struct {
+	sesh *mgo.Session
+	db   *mgo.Database
+}
+
+// NewMongoCache connects to MongoDB at addr and caches threads in the database called name.
+func NewMongoCache(addr, name string) (ThreadCache, error) {
+	sesh, err := mgo.DialWithTimeout(addr, mongoDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("connected to cache", "addr", addr, "db", name)
+	return &mongoCache{sesh: sesh, db: sesh.DB(name)}, nil
+}
+
+func (c *mongoCache) threads() *mgo.Collection {
+	return c.db.C("threads")
+}
+
+func (c *mongoCache) Get(id string) (*CachedThread, error) {
+	var t CachedThread
+	err := c.threads().FindId(id).One(&t)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotCached
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (c *mongoCache) Upsert(t CachedThread) error {
+	_, err := c.threads().UpsertId(t.ID, t)
+	return err
+}
+
+func (c *mongoCache) Delete(id string) error {
+	err := c.threads().RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (c *mongoCache) List() ([]string, error) {
+	var docs []struct {
+		ID string `bson:"_id"`
+	}
+	if err := c.threads().Find(nil).Select(bson.M{"_id": 1}).All(&docs); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(docs))
+	for _, d := range docs {
+		ids = append(ids, d.ID)
+	}
+	return ids, nil
+}
+
+func (c *mongoCache) Expire(before time.Time) (int, error) {
+	info, err := c.threads().RemoveAll(bson.M{"updated": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+func (c *mongoCache) Ping() error {
+	return c.sesh.Ping()
+}
+
+func (c *mongoCache) Close() error {
+	c.sesh.Close()
+	return nil
+}
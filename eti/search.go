@@ -0,0 +1,331 @@
+package eti
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"code.google.com/p/go.net/html"
+	"github.com/guregu/bbs"
+)
+
+// searchLimit is the most threads a search returns.
+const searchLimit = 50
+
+// how long to wait before trying to build an index again when we can't list the cache.
+// It doubles every try, up to maxIndexRetryDelay.
+const (
+	indexRetryDelay    = 10 * time.Second
+	maxIndexRetryDelay = 10 * time.Minute
+)
+
+// searchIndex finds cached threads by the words in their messages, authors, titles and tags.
+// It's kept in memory and built from the cache in the background when the cache is first used,
+// then kept up to date as threads are cached and expired.
+type searchIndex struct {
+	cache ThreadCache
+
+	mu      sync.RWMutex
+	ready   bool                           // done building
+	words   map[string]map[string]struct{} // word → thread ids
+	threads map[string]indexedThread       // thread id → what we indexed
+}
+
+// indexedThread is what we know about an indexed thread:
+// enough to list it, and to tell who can see it without going to the cache.
+type indexedThread struct {
+	words   []string
+	updated time.Time
+	listing bbs.ThreadListing
+	access  map[string]bool
+
+	// for telling if access is stale
+	metadataFetched time.Time
+	archived        bool
+}
+
+// map[ThreadCache]*searchIndex, so sites sharing a cache share its index
+var indexes = struct {
+	sync.Mutex
+	m map[ThreadCache]*searchIndex
+}{m: make(map[ThreadCache]*searchIndex)}
+
+// indexFor returns c's search index, starting to build it if it's new.
+func indexFor(c ThreadCache) *searchIndex {
+	indexes.Lock()
+	defer indexes.Unlock()
+	idx, ok := indexes.m[c]
+	if !ok {
+		idx = newSearchIndex(c)
+		indexes.m[c] = idx
+		if lru, ok := c.(*lruCache); ok {
+			lru.onEvict(idx.remove)
+		}
+		go idx.build()
+	}
+	return idx
+}
+
+func newSearchIndex(c ThreadCache) *searchIndex {
+	return &searchIndex{
+		cache:   c,
+		words:   make(map[string]map[string]struct{}),
+		threads: make(map[string]indexedThread),
+	}
+}
+
+// build indexes everything in the cache, trying again later if it can't.
+func (idx *searchIndex) build() {
+	delay := indexRetryDelay
+	for {
+		start := time.Now()
+		ids, err := idx.cache.List()
+		if err == nil {
+			for _, id := range ids {
+				if md, err := idx.cache.Get(id); err == nil {
+					idx.add(*md)
+				}
+			}
+			idx.mu.Lock()
+			idx.ready = true
+			idx.mu.Unlock()
+			log.Info("indexed cached threads", "threads", len(ids), "took", time.Since(start))
+			return
+		}
+
+		log.Warn("couldn't list cached threads to index, trying again later", "error", err, "delay", delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxIndexRetryDelay {
+			delay = maxIndexRetryDelay
+		}
+	}
+}
+
+// add indexes a thread, replacing what we had for it unless that's newer.
+func (idx *searchIndex) add(md CachedThread) {
+	words := threadWords(md)
+	access := make(map[string]bool, len(md.Access))
+	for k, v := range md.Access {
+		access[k] = v
+	}
+	it := indexedThread{
+		words:   words,
+		updated: md.Updated,
+		listing: threadListing(md),
+		access:  access,
+
+		metadataFetched: md.MetadataFetched,
+		archived:        md.Archived,
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if old, ok := idx.threads[md.ID]; ok {
+		if old.updated.After(md.Updated) {
+			return
+		}
+		idx.unindex(md.ID, old.words)
+	}
+	for _, w := range words {
+		ids, ok := idx.words[w]
+		if !ok {
+			ids = make(map[string]struct{})
+			idx.words[w] = ids
+		}
+		ids[md.ID] = struct{}{}
+	}
+	idx.threads[md.ID] = it
+}
+
+// remove forgets a thread, like one that's been evicted from the cache.
+func (idx *searchIndex) remove(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if old, ok := idx.threads[id]; ok {
+		idx.unindex(id, old.words)
+		delete(idx.threads, id)
+	}
+}
+
+// expire forgets threads that haven't been updated since before, like the cache does.
+func (idx *searchIndex) expire(before time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for id, it := range idx.threads {
+		if it.updated.Before(before) {
+			idx.unindex(id, it.words)
+			delete(idx.threads, id)
+		}
+	}
+}
+
+func (idx *searchIndex) unindex(id string, words []string) {
+	for _, w := range words {
+		delete(idx.words[w], id)
+		if len(idx.words[w]) == 0 {
+			delete(idx.words, w)
+		}
+	}
+}
+
+// find lists up to limit threads that have every one of these words, most recently updated first.
+// Only threads that s lets user see are listed (see Site.allowed): none with danger tags,
+// and only ones user is known to be allowed to see.
+// Threads with stale metadata aren't listed at all, since their tags and who can see them might have changed.
+func (idx *searchIndex) find(terms []string, s *Site, user string, limit int) []bbs.ThreadListing {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var found []indexedThread
+	for id := range idx.words[terms[0]] {
+		it := idx.threads[id]
+		if !idx.hasAll(id, terms[1:]) {
+			continue
+		}
+		if stale(s.Freshness.Metadata, it.archived, it.metadataFetched) {
+			continue
+		}
+		if _, danger := s.dangerous(it.listing.Tags); danger {
+			continue
+		}
+		if ok, known := s.allowed(it.access, it.listing.Tags, user); !ok || !known {
+			continue
+		}
+		found = append(found, it)
+	}
+	sort.Sort(byUpdated(found))
+
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	threads := make([]bbs.ThreadListing, 0, len(found))
+	for _, it := range found {
+		threads = append(threads, it.listing)
+	}
+	return threads
+}
+
+// hasAll is true if thread id has every one of these words. idx.mu must be held.
+func (idx *searchIndex) hasAll(id string, terms []string) bool {
+	for _, term := range terms {
+		if _, ok := idx.words[term][id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// isReady is true once the index has everything that was in the cache.
+func (idx *searchIndex) isReady() bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.ready
+}
+
+type byUpdated []indexedThread
+
+func (b byUpdated) Len() int           { return len(b) }
+func (b byUpdated) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byUpdated) Less(i, j int) bool { return b[i].updated.After(b[j].updated) }
+
+// threadListing is how a cached thread shows up in search results.
+func threadListing(md CachedThread) bbs.ThreadListing {
+	listing := bbs.ThreadListing{
+		ID:        md.ID,
+		Title:     md.Thread.Title,
+		PostCount: len(md.Thread.Messages),
+		Closed:    md.Thread.Closed,
+		Tags:      append([]string(nil), md.Thread.Tags...),
+	}
+	if len(md.Thread.Messages) > 0 {
+		op := md.Thread.Messages[0]
+		listing.Author, listing.AuthorID, listing.Date = op.Author, op.AuthorID, op.Date
+	}
+	return listing
+}
+
+// Expire drops threads that haven't been updated since before from c, and from its search index.
+// Use it instead of c.Expire so searches don't list expired threads.
+func Expire(c ThreadCache, before time.Time) (int, error) {
+	n, err := c.Expire(before)
+	if n > 0 {
+		indexFor(c).expire(before)
+	}
+	return n, err
+}
+
+// threadWords is every distinct word in a thread's title, tags, authors and messages.
+func threadWords(md CachedThread) []string {
+	seen := make(map[string]bool)
+	var words []string
+	add := func(text string) {
+		for _, w := range splitWords(text) {
+			if !seen[w] {
+				seen[w] = true
+				words = append(words, w)
+			}
+		}
+	}
+
+	add(md.Thread.Title)
+	for _, tag := range md.Thread.Tags {
+		add(tag)
+	}
+	for _, msg := range md.Thread.Messages {
+		add(msg.Author)
+		if md.Thread.Format == "html" {
+			add(htmlText(msg.Text))
+		} else {
+			add(msg.Text)
+		}
+	}
+	return words
+}
+
+// splitWords lowercases text and splits it into words.
+func splitWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// htmlText is the text of some HTML, without the tags.
+func htmlText(s string) string {
+	var text []string
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return strings.Join(text, " ")
+		case html.TextToken:
+			text = append(text, string(z.Text()))
+		}
+	}
+}
+
+// search lists cached threads that have every word in query.
+// Only threads this session's user is known to be allowed to see are listed:
+// ones they've opened through the relay, ones on boards they've been let into, or ones that only have shared tags.
+func (client *ETI) search(query string) (bbs.ListMessage, error) {
+	site := client.site
+	if site.cache == nil {
+		return bbs.ListMessage{}, errors.New("search needs the cache turned on")
+	}
+	terms := splitWords(query)
+	if len(terms) == 0 {
+		return bbs.ListMessage{}, errors.New("nothing to search for")
+	}
+	if !site.index.isReady() {
+		return bbs.ListMessage{}, errors.New("still indexing cached threads, try again in a bit")
+	}
+
+	return bbs.ListMessage{
+		Command: "list",
+		Type:    "search",
+		Query:   query,
+		Threads: site.index.find(terms, site, client.Username, searchLimit),
+	}, nil
+}
@@ -0,0 +1,172 @@
+package eti
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/guregu/bbs"
+)
+
+func TestSplitWords(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Hello, World!", []string{"hello", "world"}},
+		{"  LUE  lue\tLUElinks ", []string{"lue", "lue", "luelinks"}},
+		{"don't stop-believin' 2night", []string{"don", "t", "stop", "believin", "2night"}},
+		{"日本語 テキスト", []string{"日本語", "テキスト"}},
+		{"", []string{}},
+		{"!!! ...", []string{}},
+	}
+	for _, test := range tests {
+		if got := splitWords(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitWords(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestHTMLText(t *testing.T) {
+	tests := []struct {
+		html string
+		want string
+	}{
+		{"plain", "plain"},
+		{"<b>bold</b> move", "bold  move"},
+		{`<a href="http://example.com/secret">link</a>`, "link"},
+		{"a<br/>b", "a b"},
+		{"fish &amp; chips", "fish & chips"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := htmlText(test.html); got != test.want {
+			t.Errorf("htmlText(%q) = %q, want %q", test.html, got, test.want)
+		}
+	}
+}
+
+// testThread is a cached thread with one message, that alice has opened.
+func testThread(id, title, text string, updated time.Time, tags ...string) CachedThread {
+	md := CachedThread{
+		ID:              id,
+		Updated:         updated,
+		MetadataFetched: time.Now(),
+		Thread: bbs.ThreadMessage{
+			ID:       id,
+			Title:    title,
+			Tags:     tags,
+			Messages: []bbs.Message{{ID: id + "-1", Author: "bob", Text: text}},
+		},
+	}
+	md.allow("alice", true)
+	return md
+}
+
+func listedIDs(threads []bbs.ThreadListing) []string {
+	var ids []string
+	for _, t := range threads {
+		ids = append(ids, t.ID)
+	}
+	return ids
+}
+
+func TestFind(t *testing.T) {
+	site := NewSite()
+	site.SharedTags = []string{"LUE"}
+	site.boards.let("dave", []string{"Pets"})
+	idx := newSearchIndex(nil)
+
+	now := time.Now()
+	idx.add(testThread("1", "Cats", "i like cats", now.Add(-3*time.Hour), "Pets"))
+	idx.add(testThread("2", "More cats", "cats are <b>great</b>", now.Add(-1*time.Hour), "Pets"))
+	idx.add(testThread("3", "Dogs", "dogs are great too", now.Add(-2*time.Hour), "Pets"))
+	idx.add(testThread("4", "Secret cats", "cats", now, "TCF"))
+	notOpened := testThread("5", "Shared cats", "cats", now.Add(-4*time.Hour), "LUE")
+	notOpened.Access = nil
+	idx.add(notOpened)
+	denied := testThread("6", "Denied cats", "cats", now, "Pets")
+	denied.allow("alice", false)
+	idx.add(denied)
+	// nobody's checked the title, tags or who can see these in a while
+	staleThread := testThread("7", "Stale cats", "cats", now, "Pets")
+	staleThread.MetadataFetched = now.Add(-time.Hour)
+	idx.add(staleThread)
+	archived := testThread("8", "Archived cats", "cats", now.Add(-5*time.Hour), "Pets")
+	archived.MetadataFetched, archived.Archived = now.Add(-time.Hour), true
+	idx.add(archived)
+
+	tests := []struct {
+		terms []string
+		user  string
+		limit int
+		want  []string
+	}{
+		{[]string{"cats"}, "alice", 50, []string{"2", "1", "5", "8"}},
+		{[]string{"cats", "great"}, "alice", 50, []string{"2"}},
+		{[]string{"great"}, "alice", 50, []string{"2", "3"}},
+		{[]string{"bob"}, "alice", 50, []string{"2", "3", "1", "5", "8"}},
+		{[]string{"pets"}, "alice", 50, []string{"2", "3", "1", "8"}},
+		{[]string{"cats"}, "alice", 2, []string{"2", "1"}},
+		{[]string{"cats"}, "ALICE", 50, []string{"2", "1", "5", "8"}},
+		// carol hasn't opened anything, so she only sees threads with shared tags
+		{[]string{"cats"}, "carol", 50, []string{"5"}},
+		// dave has been let into Pets, so that covers the one alice was denied, but not TCF
+		{[]string{"cats"}, "dave", 50, []string{"6", "2", "1", "5", "8"}},
+		{[]string{"horses"}, "alice", 50, nil},
+	}
+	for _, test := range tests {
+		got := listedIDs(idx.find(test.terms, site, test.user, test.limit))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("find(%v) for %s = %v, want %v", test.terms, test.user, got, test.want)
+		}
+	}
+}
+
+func TestFindUpdates(t *testing.T) {
+	site := NewSite()
+	idx := newSearchIndex(nil)
+	now := time.Now()
+
+	idx.add(testThread("1", "Cats", "cats", now))
+	// an older snapshot saved late doesn't replace a newer one
+	idx.add(testThread("1", "Dogs", "dogs", now.Add(-time.Hour)))
+	if got := listedIDs(idx.find([]string{"dogs"}, site, "alice", 50)); got != nil {
+		t.Errorf("older snapshot was indexed: %v", got)
+	}
+	// a newer one does
+	idx.add(testThread("1", "Dogs", "dogs", now.Add(time.Hour)))
+	if got := listedIDs(idx.find([]string{"cats"}, site, "alice", 50)); got != nil {
+		t.Errorf("replaced words are still indexed: %v", got)
+	}
+	if got := idx.find([]string{"dogs"}, site, "alice", 50); len(got) != 1 || got[0].Title != "Dogs" {
+		t.Errorf("find(dogs) = %v", got)
+	}
+
+	idx.expire(now.Add(2 * time.Hour))
+	if len(idx.threads) != 0 || len(idx.words) != 0 {
+		t.Errorf("expired threads are still indexed: %v %v", idx.threads, idx.words)
+	}
+}
+
+func TestIndexEvicted(t *testing.T) {
+	c := NewMemoryCache(1)
+	idx := indexFor(c)
+	site := NewSite()
+	site.UseCache(c)
+
+	for !idx.isReady() {
+		time.Sleep(time.Millisecond)
+	}
+
+	now := time.Now()
+	for _, md := range []CachedThread{testThread("1", "Cats", "cats", now), testThread("2", "Dogs", "dogs", now)} {
+		site.updateThread(md)
+	}
+	if got := listedIDs(idx.find([]string{"cats"}, site, "alice", 50)); got != nil {
+		t.Errorf("thread the cache forgot is still indexed: %v", got)
+	}
+	if got := listedIDs(idx.find([]string{"dogs"}, site, "alice", 50)); !reflect.DeepEqual(got, []string{"2"}) {
+		t.Errorf("find(dogs) = %v, want [2]", got)
+	}
+}
@@ -3,17 +3,16 @@ package eti
 import (
 	"errors"
 	"fmt"
-	"log"
 	"math"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"code.google.com/p/go.net/html"
 	"code.google.com/p/go.net/html/atom"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/guregu/bbs"
-	_ "labix.org/v2/mgo/bson"
+	"github.com/guregu/relay/metrics"
 )
 
 var (
@@ -22,56 +21,240 @@ var (
 	sessionError      = errors.New("session")
 )
 
-var dangerTags = map[string]bool{
-	"TCF":         true,
-	"TCF Lite":    true,
-	"Moderations": true,
-}
-
-type metadata struct {
+// CachedThread is a thread as we keep it in a ThreadCache.
+type CachedThread struct {
 	ID       string `bson:"_id"`
 	Thread   bbs.ThreadMessage
 	Archived bool
-	Updated  time.Time
-	Access   map[string]bool `bson:",omitempty"`
+	Updated  time.Time       // when this snapshot of it was saved
+	Access   map[string]bool `bson:",omitempty"` // who ETI will (true) and won't (false) show it to, see accessKey
+
+	// when we last got the title, tags and closed/archived state, and the messages, from ETI
+	MetadataFetched time.Time
+	MessagesFetched time.Time
 
 	pages int
 }
 
-func getThread(id string) *metadata {
-	if db == nil {
+// Freshness is how long cached thread details are good for before we get them from ETI again.
+// Zero means forever. Archived threads never change, so they're always fresh.
+type Freshness struct {
+	Metadata time.Duration // title, tags, and closed/archived state
+	Messages time.Duration // the messages themselves, which can be edited or deleted
+}
+
+// DefaultFreshness is the Freshness sites start out with.
+var DefaultFreshness = Freshness{
+	Metadata: 10 * time.Minute,
+	Messages: 1 * time.Hour,
+}
+
+func (f Freshness) staleMetadata(md *CachedThread) bool {
+	return stale(f.Metadata, md.Archived, md.MetadataFetched)
+}
+
+func (f Freshness) staleMessages(md *CachedThread) bool {
+	return stale(f.Messages, md.Archived, md.MessagesFetched)
+}
+
+// stale is true if something fetched then is older than ttl.
+func stale(ttl time.Duration, archived bool, fetched time.Time) bool {
+	return !archived && ttl > 0 && time.Since(fetched) > ttl
+}
+
+// refreshMetadata copies what fetchMetadata got into a cached thread, keeping its messages.
+func (md *CachedThread) refreshMetadata(fresh CachedThread) {
+	md.Thread.Title = fresh.Thread.Title
+	md.Thread.Tags = fresh.Thread.Tags
+	md.Thread.Closed = fresh.Thread.Closed
+	md.Archived = fresh.Archived
+	md.MetadataFetched = fresh.MetadataFetched
+	md.pages = fresh.pages
+}
+
+// clone copies a thread deep enough that appending messages to it doesn't touch the original.
+func (t CachedThread) clone() *CachedThread {
+	t.Thread.Messages = append([]bbs.Message(nil), t.Thread.Messages...)
+	t.Thread.Tags = append([]string(nil), t.Thread.Tags...)
+	if t.Access != nil {
+		access := make(map[string]bool, len(t.Access))
+		for k, v := range t.Access {
+			access[k] = v
+		}
+		t.Access = access
+	}
+	return &t
+}
+
+func (s *Site) getThread(id string) *CachedThread {
+	if s.cache == nil {
 		return nil
 	}
 
-	var md *metadata
-	err := db.C("threads").FindId(id).One(&md)
-	if err != nil {
+	md, err := s.cache.Get(id)
+	metrics.Hit("eti_threads", err == nil)
+	switch {
+	case err == ErrNotCached:
+		return nil
+	case err != nil:
+		log.Warn("couldn't get thread from cache", "thread", id, "error", err)
 		return nil
 	}
 	return md
 }
 
-func updateThread(md metadata) {
-	if db == nil {
+func (s *Site) updateThread(md CachedThread) {
+	if s.cache == nil {
 		return
 	}
 
-	for _, tag := range md.Thread.Tags {
-		if dangerTags[tag] || strings.HasSuffix(tag, "(social)") {
-			log.Println("Danger!!", tag, md.Thread.ID)
-			return
+	if tag, ok := s.dangerous(md.Thread.Tags); ok {
+		log.Debug("not caching thread with sensitive tag", "thread", md.Thread.ID, "tag", tag)
+		return
+	}
+
+	// one write per thread at a time, so nothing gets lost between reading and writing
+	unlock := lockThread(md.ID)
+	defer unlock()
+	if old, err := s.cache.Get(md.ID); err == nil {
+		md = merge(*old, md)
+	}
+	if err := s.cache.Upsert(md); err != nil {
+		log.Warn("couldn't cache thread", "thread", md.ID, "error", err)
+		return
+	}
+	s.index.add(md)
+}
+
+// saveThread caches a thread in the background.
+// Saves can finish in any order: they're merged with what's cached, newest snapshot winning.
+func (s *Site) saveThread(md CachedThread) {
+	md.Updated = time.Now()
+	writes.Add(1)
+	go func() {
+		defer writes.Done()
+		s.updateThread(md)
+	}()
+}
+
+// map[thread id]*threadLock
+var threadLocks = struct {
+	sync.Mutex
+	m map[string]*threadLock
+}{m: make(map[string]*threadLock)}
+
+type threadLock struct {
+	sync.Mutex
+	refs int // how many people are holding or waiting for it
+}
+
+// lockThread locks a thread for writing, returning the function that unlocks it.
+func lockThread(id string) (unlock func()) {
+	threadLocks.Lock()
+	l, ok := threadLocks.m[id]
+	if !ok {
+		l = new(threadLock)
+		threadLocks.m[id] = l
+	}
+	l.refs++
+	threadLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		threadLocks.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(threadLocks.m, id)
 		}
+		threadLocks.Unlock()
+	}
+}
+
+// merge combines two snapshots of a thread so that writes never lose anything.
+// The newer snapshot wins for anything that changed, and archived threads stay archived.
+// Messages are merged by ID, so the list never gets shorter: messages deleted on ETI stay cached.
+func merge(old, md CachedThread) CachedThread {
+	older, newer := old, md
+	if md.Updated.Before(old.Updated) {
+		older, newer = md, old
 	}
 
-	db.C("threads").UpsertId(md.ID, md)
+	merged := newer
+	switch {
+	case older.MetadataFetched.After(newer.MetadataFetched):
+		merged.Thread.Title = older.Thread.Title
+		merged.Thread.Tags = older.Thread.Tags
+		merged.Thread.Closed = older.Thread.Closed
+		merged.MetadataFetched = older.MetadataFetched
+		merged.Access = older.Access
+	case older.MetadataFetched.Equal(newer.MetadataFetched):
+		// who can see it goes along with the metadata, so it's only combined when that's the same
+		merged.Access = mergeAccess(older.Access, newer.Access)
+	}
+	if older.MessagesFetched.After(newer.MessagesFetched) {
+		merged.MessagesFetched = older.MessagesFetched
+	}
+	if older.Archived {
+		merged.Archived, merged.Thread.Closed = true, true
+	}
+
+	merged.Thread.Messages = mergeMessages(older.Thread.Messages, newer.Thread.Messages)
+	merged.Thread.Total = len(merged.Thread.Messages)
+	merged.Thread.Range = bbs.Range{Start: 1, End: merged.Thread.Total}
+	return merged
+}
+
+// mergeAccess combines who can see a thread, with newer winning for anyone in both.
+func mergeAccess(older, newer map[string]bool) map[string]bool {
+	if len(older) == 0 {
+		return newer
+	}
+	merged := make(map[string]bool, len(older)+len(newer))
+	for k, v := range older {
+		merged[k] = v
+	}
+	for k, v := range newer {
+		merged[k] = v
+	}
+	return merged
+}
+
+// mergeMessages merges two lists of a thread's messages by ID, taking newer's version of each.
+// Messages only older has (like ones deleted since) are kept, in their place.
+// Messages without IDs are matched up by position.
+func mergeMessages(older, newer []bbs.Message) []bbs.Message {
+	merged := append([]bbs.Message(nil), older...)
+	index := make(map[string]int, len(merged)) // id → position in merged
+	for i, msg := range merged {
+		if msg.ID != "" {
+			index[msg.ID] = i
+		}
+	}
+	for i, msg := range newer {
+		switch pos, ok := index[msg.ID]; {
+		case msg.ID != "" && ok:
+			merged[pos] = msg
+		case msg.ID == "" && i < len(merged):
+			merged[i] = msg
+		default:
+			if msg.ID != "" {
+				index[msg.ID] = len(merged)
+			}
+			merged = append(merged, msg)
+		}
+	}
+	return merged
 }
 
-func parseToken(token string) (bbs.Range, bool) {
+// parseToken turns a token (the last post a client has seen) into the range of posts after it.
+// size is the range the client would get by default.
+func parseToken(token string, size bbs.Range) (bbs.Range, bool) {
 	last, err := strconv.Atoi(token)
 	if err != nil {
 		return bbs.Range{}, false
 	} else {
-		return bbs.Range{last + 1, last + DefaultRange.End}, true
+		return bbs.Range{Start: last + 1, End: last + size.End}, true
 	}
 }
 
@@ -0,0 +1,220 @@
+package eti
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/guregu/bbs"
+)
+
+// msgs makes messages from "id:text" pairs. Leave out the id (":text") for a message without one.
+func msgs(specs ...string) []bbs.Message {
+	var list []bbs.Message
+	for _, spec := range specs {
+		kv := strings.SplitN(spec, ":", 2)
+		list = append(list, bbs.Message{ID: kv[0], Text: kv[1]})
+	}
+	return list
+}
+
+func TestMergeMessages(t *testing.T) {
+	tests := []struct {
+		name         string
+		older, newer []bbs.Message
+		want         []bbs.Message
+	}{
+		{
+			name:  "newer has more",
+			older: msgs("1:a", "2:b"),
+			newer: msgs("1:a", "2:b", "3:c"),
+			want:  msgs("1:a", "2:b", "3:c"),
+		},
+		{
+			name:  "shorter snapshot",
+			older: msgs("1:a", "2:b", "3:c"),
+			newer: msgs("1:a"),
+			want:  msgs("1:a", "2:b", "3:c"),
+		},
+		{
+			name:  "newer wins edits",
+			older: msgs("1:a", "2:b"),
+			newer: msgs("2:edited"),
+			want:  msgs("1:a", "2:edited"),
+		},
+		{
+			name:  "reordered",
+			older: msgs("1:a", "2:b", "3:c"),
+			newer: msgs("3:c2", "1:a2", "4:d"),
+			want:  msgs("1:a2", "2:b", "3:c2", "4:d"),
+		},
+		{
+			name:  "without IDs",
+			older: msgs(":a", ":b"),
+			newer: msgs(":a2", ":b2", ":c"),
+			want:  msgs(":a2", ":b2", ":c"),
+		},
+		{
+			name:  "shorter without IDs",
+			older: msgs(":a", ":b", ":c"),
+			newer: msgs(":a2"),
+			want:  msgs(":a2", ":b", ":c"),
+		},
+		{
+			name:  "empty",
+			older: nil,
+			newer: msgs("1:a"),
+			want:  msgs("1:a"),
+		},
+	}
+	for _, test := range tests {
+		got := mergeMessages(test.older, test.newer)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMergeMessagesDoesntTouchOlder(t *testing.T) {
+	older := msgs("1:a", "2:b")
+	mergeMessages(older, msgs("1:changed"))
+	if older[0].Text != "a" {
+		t.Errorf("older was changed: %v", older)
+	}
+}
+
+func TestMergeNeverShrinks(t *testing.T) {
+	then := time.Now().Add(-time.Hour)
+	now := time.Now()
+	tests := []struct {
+		name    string
+		old, md CachedThread
+		want    []bbs.Message
+	}{
+		{
+			// even a newer fetch of the whole thread doesn't drop messages deleted since
+			name: "newer fetch without a deleted message",
+			old:  CachedThread{Updated: then, MessagesFetched: then, Thread: bbs.ThreadMessage{Messages: msgs("1:a", "2:b", "3:c")}},
+			md:   CachedThread{Updated: now, MessagesFetched: now, Thread: bbs.ThreadMessage{Messages: msgs("1:a", "3:c2")}},
+			want: msgs("1:a", "2:b", "3:c2"),
+		},
+		{
+			name: "older fetch saved later",
+			old:  CachedThread{Updated: then, MessagesFetched: now, Thread: bbs.ThreadMessage{Messages: msgs("1:a", "2:b", "3:c")}},
+			md:   CachedThread{Updated: now, MessagesFetched: then, Thread: bbs.ThreadMessage{Messages: msgs("1:a")}},
+			want: msgs("1:a", "2:b", "3:c"),
+		},
+		{
+			name: "newer has more",
+			old:  CachedThread{Updated: then, MessagesFetched: then, Thread: bbs.ThreadMessage{Messages: msgs("1:a")}},
+			md:   CachedThread{Updated: now, MessagesFetched: now, Thread: bbs.ThreadMessage{Messages: msgs("1:a", "2:b")}},
+			want: msgs("1:a", "2:b"),
+		},
+		{
+			name: "without IDs",
+			old:  CachedThread{Updated: then, MessagesFetched: then, Thread: bbs.ThreadMessage{Messages: msgs(":a", ":b", ":c")}},
+			md:   CachedThread{Updated: now, MessagesFetched: now, Thread: bbs.ThreadMessage{Messages: msgs(":a2", ":b2")}},
+			want: msgs(":a2", ":b2", ":c"),
+		},
+	}
+	for _, test := range tests {
+		got := merge(test.old, test.md)
+		if !reflect.DeepEqual(got.Thread.Messages, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got.Thread.Messages, test.want)
+		}
+		if got.Thread.Total != len(test.want) || got.Thread.Range != (bbs.Range{Start: 1, End: len(test.want)}) {
+			t.Errorf("%s: total %d, range %v", test.name, got.Thread.Total, got.Thread.Range)
+		}
+		// it shouldn't matter which one was already cached
+		if swapped := merge(test.md, test.old); !reflect.DeepEqual(swapped.Thread.Messages, test.want) {
+			t.Errorf("%s (swapped): got %v, want %v", test.name, swapped.Thread.Messages, test.want)
+		}
+	}
+}
+
+func TestMergeArchived(t *testing.T) {
+	then := time.Now().Add(-time.Hour)
+	now := time.Now()
+	old := CachedThread{Updated: then, Archived: true, Thread: bbs.ThreadMessage{Closed: true}}
+	md := CachedThread{Updated: now}
+
+	for _, got := range []CachedThread{merge(old, md), merge(md, old)} {
+		if !got.Archived || !got.Thread.Closed {
+			t.Errorf("archived = %v, closed = %v; want both", got.Archived, got.Thread.Closed)
+		}
+	}
+}
+
+func TestMergeMetadata(t *testing.T) {
+	then := time.Now().Add(-time.Hour)
+	now := time.Now()
+
+	// saved later, but with older metadata: the title, tags and access come from the other one
+	old := CachedThread{
+		Updated:         then,
+		MetadataFetched: now,
+		MessagesFetched: now,
+		Thread:          bbs.ThreadMessage{Title: "new title", Tags: []string{"LUE"}},
+		Access:          map[string]bool{"user:alice": true},
+	}
+	md := CachedThread{
+		Updated:         now,
+		MetadataFetched: then,
+		MessagesFetched: then,
+		Thread:          bbs.ThreadMessage{Title: "old title", Closed: true},
+		Access:          map[string]bool{"user:bob": true},
+	}
+	got := merge(old, md)
+	if got.Thread.Title != "new title" || !reflect.DeepEqual(got.Thread.Tags, []string{"LUE"}) || got.Thread.Closed {
+		t.Errorf("metadata = %q %v closed=%v, want the newer fetch's", got.Thread.Title, got.Thread.Tags, got.Thread.Closed)
+	}
+	if !reflect.DeepEqual(got.Access, old.Access) {
+		t.Errorf("access = %v, want %v", got.Access, old.Access)
+	}
+	if !got.MetadataFetched.Equal(now) || !got.MessagesFetched.Equal(now) {
+		t.Errorf("fetched = %v / %v, want the later times", got.MetadataFetched, got.MessagesFetched)
+	}
+	if !got.Updated.Equal(now) {
+		t.Errorf("updated = %v, want %v", got.Updated, now)
+	}
+
+	// same metadata: who can see it is combined
+	md.MetadataFetched = now
+	got = merge(old, md)
+	want := map[string]bool{"user:alice": true, "user:bob": true}
+	if !reflect.DeepEqual(got.Access, want) {
+		t.Errorf("access = %v, want %v", got.Access, want)
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	f := Freshness{Metadata: 10 * time.Minute, Messages: time.Hour}
+	now := time.Now()
+	tests := []struct {
+		name                 string
+		md                   CachedThread
+		staleMeta, staleMsgs bool
+	}{
+		{"just fetched", CachedThread{MetadataFetched: now, MessagesFetched: now}, false, false},
+		{"metadata stale first", CachedThread{MetadataFetched: now.Add(-20 * time.Minute), MessagesFetched: now.Add(-20 * time.Minute)}, true, false},
+		{"both stale", CachedThread{MetadataFetched: now.Add(-2 * time.Hour), MessagesFetched: now.Add(-2 * time.Hour)}, true, true},
+		{"never fetched", CachedThread{}, true, true},
+		{"archived never changes", CachedThread{Archived: true}, false, false},
+	}
+	for _, test := range tests {
+		if got := f.staleMetadata(&test.md); got != test.staleMeta {
+			t.Errorf("%s: staleMetadata = %v, want %v", test.name, got, test.staleMeta)
+		}
+		if got := f.staleMessages(&test.md); got != test.staleMsgs {
+			t.Errorf("%s: staleMessages = %v, want %v", test.name, got, test.staleMsgs)
+		}
+	}
+
+	// zero means forever
+	forever := Freshness{}
+	old := CachedThread{MetadataFetched: now.Add(-1000 * time.Hour), MessagesFetched: now.Add(-1000 * time.Hour)}
+	if forever.staleMetadata(&old) || forever.staleMessages(&old) {
+		t.Error("with no ttl, nothing should go stale")
+	}
+}
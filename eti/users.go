@@ -0,0 +1,25 @@
+package eti
+
+import (
+	"time"
+
+	"github.com/guregu/relay/metrics"
+	"github.com/pmylund/go-cache"
+)
+
+// map[username]struct{}, everyone who's logged in and used the relay lately.
+// Sessions don't tell us when they go away, so users drop off after sitting idle instead.
+var activeUsers = cache.New(30*time.Minute, 5*time.Minute)
+
+func init() {
+	metrics.NewGaugeFunc("relay_eti_users",
+		"ETI users who are logged in and have been active in the last 30 minutes.",
+		func() float64 {
+			return float64(activeUsers.ItemCount())
+		})
+}
+
+// seen marks a user as active.
+func seen(username string) {
+	activeUsers.Set(username, struct{}{}, 0)
+}
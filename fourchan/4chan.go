@@ -1,60 +1,47 @@
+// Package fourchan relays 4chan, and other imageboards that speak its JSON API (vichan, Tinyboard, etc).
 package fourchan
 
 import (
 	"code.google.com/p/go.net/html"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/guregu/bbs"
-	"io/ioutil"
-	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
-const threadURL = "http://api.4chan.org/%s/res/%s.json"
-const boardURL = "http://api.4chan.org/%s/%d.json"
-const catalogURL = "http://api.4chan.org/%s/catalog.json"
-const boardListURL = "http://api.4chan.org/boards.json"
-const imageURL = "http://images.4chan.org/%s/src/%d%s"
-const thumbnailURL = "http://thumbs.4chan.org/%s/thumb/%d%s"
-const spoilerImageURL = "http://static.4chan.org/image/spoiler.png"
-
-var Hello = bbs.HelloMessage{
-	Command:         "hello",
-	Name:            "Fourchan relay",
-	ProtocolVersion: 0,
-	Description:     "4chan -> BBS Relay",
-	Options:         []string{"imageboard", "readonly", "boards"},
-	Access: bbs.AccessInfo{
-		// There are no user commands.
-		GuestCommands: []string{"hello", "get", "list"},
-	},
-	Formats:       []string{"html", "text"},
-	Lists:         []string{"thread", "board"},
-	ServerVersion: "4chan-relay 0.1",
+// 4chan's base URLs
+const DefaultAPIURL = "https://a.4cdn.org"
+const DefaultImageURL = "https://i.4cdn.org"
+const DefaultStaticURL = "https://s.4cdn.org"
+
+// DefaultHello returns the Hello imageboard sites start out with.
+// The "watch" option means new posts can be pushed from <path>/watch (see WatchHandler),
+// the realtime URL with /ws swapped for /watch.
+func DefaultHello() bbs.HelloMessage {
+	return bbs.HelloMessage{
+		Command:         "hello",
+		Name:            "Fourchan relay",
+		ProtocolVersion: 0,
+		Description:     "4chan -> BBS Relay",
+		Options:         []string{"imageboard", "readonly", "boards", "watch", "range", "filter"},
+		Access: bbs.AccessInfo{
+			// There are no user commands.
+			GuestCommands: []string{"hello", "get", "list"},
+		},
+		Formats:       []string{"html", "text"},
+		Lists:         []string{"thread", "board"},
+		ServerVersion: "4chan-relay 0.1",
+	}
 }
 
 var readOnlyError = errors.New("This gateway is read-only.")
 
+// Fourchan is a bbs session on an imageboard site.
 type Fourchan struct {
-}
-
-func Setup(name, desc, realtimePath string) {
-	if name != "" {
-		Hello.Name = name
-	}
-	if desc != "" {
-		Hello.Description = desc
-	}
-	Hello.Name = maybe(name, "Fourchan")
-	Hello.Description = maybe(desc, "ETI Gateway")
-	Hello.RealtimeURL = realtimePath
-}
-
-func New() bbs.BBS {
-	return new(Fourchan)
+	site *Site
 }
 
 type Catalog []Page
@@ -69,28 +56,36 @@ type Thread struct {
 }
 
 type FourchanPost struct {
-	Number        int    `json:"no"`
-	ReplyTo       int    `json:"resto"`
-	Sticky        int    `json:"sticky,omitempty"`
-	Closed        int    `json:"closed,omitempty"`
-	Date          string `json:"now"`
-	Timestamp     int    `json:"time"`
-	Name          string `json:"name,omitempty"` //username
-	Tripcode      string `json:"trip,omitempty"`
-	ID            string `json:"id,omitempty"` //user ID
-	Capcode       string `json:"capcode,omitempty"`
-	CountryName   string `json:"country_name,omitempty"`
-	Email         string `json:"email,omitempty"`
-	Subject       string `json:"sub,omitempty"`
-	Text          string `json:"com,omitempty"` //HTML
-	FileTime      uint64 `json:"tim,omitempty"`
-	FileExt       string `json:"ext,omitempty"`
-	FileDeleted   int    `json:"filedeleted,omitempty"`
-	Spoiler       int    `json:"spoiler,omitempty"`
-	OmitedPosts   int    `json:"omitted_posts,omitempty"`
-	OmittedImages int    `json:"omitted_images,omitempty"`
-	Replies       int    `json:"replies,omitempty"`
-	Images        int    `json:"images,omitempty"`
+	Number        int      `json:"no"`
+	ReplyTo       int      `json:"resto"`
+	Sticky        int      `json:"sticky,omitempty"`
+	Closed        int      `json:"closed,omitempty"`
+	Archived      int      `json:"archived,omitempty"`
+	Date          string   `json:"now"`
+	Timestamp     int      `json:"time"`
+	Name          string   `json:"name,omitempty"` //username
+	Tripcode      string   `json:"trip,omitempty"`
+	ID            string   `json:"id,omitempty"` //user ID
+	Capcode       string   `json:"capcode,omitempty"`
+	CountryName   string   `json:"country_name,omitempty"`
+	Email         string   `json:"email,omitempty"`
+	Subject       string   `json:"sub,omitempty"`
+	Text          string   `json:"com,omitempty"` //HTML
+	FileTime      LooseInt `json:"tim,omitempty"`
+	FileExt       string   `json:"ext,omitempty"`
+	Filename      string   `json:"filename,omitempty"` //without the extension
+	FileSize      int      `json:"fsize,omitempty"`    //bytes
+	FileMD5       string   `json:"md5,omitempty"`      //base64
+	Width         int      `json:"w,omitempty"`
+	Height        int      `json:"h,omitempty"`
+	ThumbWidth    int      `json:"tn_w,omitempty"`
+	ThumbHeight   int      `json:"tn_h,omitempty"`
+	FileDeleted   int      `json:"filedeleted,omitempty"`
+	Spoiler       int      `json:"spoiler,omitempty"`
+	OmitedPosts   int      `json:"omitted_posts,omitempty"`  //index pages only
+	OmittedImages int      `json:"omitted_images,omitempty"` //index pages only
+	Replies       int      `json:"replies,omitempty"`
+	Images        int      `json:"images,omitempty"` //replies with files, for sort:images
 }
 
 type Boards struct {
@@ -111,7 +106,7 @@ func (b Board) String() string {
 }
 
 func (f *Fourchan) Hello() bbs.HelloMessage {
-	return Hello
+	return f.site.Hello
 }
 
 func (f *Fourchan) Register(m bbs.RegisterCommand) (okm bbs.OKMessage, err error) {
@@ -132,10 +127,15 @@ func (f *Fourchan) IsLoggedIn() bool {
 
 func (f *Fourchan) Get(m bbs.GetCommand) (tm bbs.ThreadMessage, err error) {
 	//ThreadIDs are in this format:
-	// board/id
-	// like: cgl/4323443
+	// board:id
+	// like: cgl:4323443
+	// index previews add the post, like cgl:4323443#p4323500, but we get the whole thread
 
-	split := strings.Split(m.ThreadID, ":")
+	id := m.ThreadID
+	if i := strings.Index(id, "#"); i != -1 {
+		id = id[:i]
+	}
+	split := strings.Split(id, ":")
 	if len(split) != 2 {
 		return bbs.ThreadMessage{}, errors.New("Invalid Thread ID: " + m.ThreadID)
 	}
@@ -143,77 +143,97 @@ func (f *Fourchan) Get(m bbs.GetCommand) (tm bbs.ThreadMessage, err error) {
 	board := split[0]
 	threadID := split[1]
 
-	url := fmt.Sprintf(threadURL, board, threadID)
-	data, code := getBytes(url)
-	if code == 404 {
-		return bbs.ThreadMessage{}, errors.New(fmt.Sprintf("Thread /%s/%s not found.", board, threadID))
-	} else if code != 200 {
-		return bbs.ThreadMessage{}, errors.New(fmt.Sprintf("4chan error %d", code))
-	}
-
 	//4chan json in
 	var c = Thread{}
-	json.Unmarshal(data, &c)
+	url := f.site.threadURL(board, threadID)
+	if err := f.site.getJSON(url, fmt.Sprintf("Thread /%s/%s", board, threadID), &c); err != nil {
+		return bbs.ThreadMessage{}, err
+	}
 
 	if len(c.Posts) == 0 {
 		return bbs.ThreadMessage{}, errors.New("No posts!")
 	}
 
-	//bbs json out
-	var messages []bbs.Message
 	op := c.Posts[0]
+	posts := c.Posts
 
-	for i := range c.Posts {
-		t := c.Posts[i]
-		text := t.Text
-		if m.Format == "text" {
-			text = unhtml(text)
+	// filter by poster
+	if m.Filter != "" {
+		match, err := posterFilter(m.Filter, op)
+		if err != nil {
+			return bbs.ThreadMessage{}, err
 		}
-
-		thumb := fmt.Sprintf(thumbnailURL, board, t.FileTime, t.FileExt)
-		if t.Spoiler != 0 {
-			thumb = spoilerImageURL
+		posts = nil
+		for _, p := range c.Posts {
+			if match(p) {
+				posts = append(posts, p)
+			}
 		}
+	}
 
-		if t.FileTime != 0 {
-			messages = append(messages, bbs.Message{
-				ID:           strconv.Itoa(t.Number),
-				Author:       name(t),
-				AuthorID:     t.ID,
-				Date:         t.Date,
-				Text:         text,
-				PictureURL:   fmt.Sprintf(imageURL, board, t.FileTime, t.FileExt),
-				ThumbnailURL: thumb,
-			})
+	// tokens are post numbers: give me everything after this post
+	start, stop := 0, len(posts)
+	if m.Token != "" {
+		last, err := strconv.Atoi(m.Token)
+		if err != nil {
+			return bbs.ThreadMessage{}, errors.New("Invalid token: " + m.Token)
+		}
+		start = len(posts) - len(after(posts, last))
+	}
+	// ranges are 1-indexed post positions, like ETI
+	// with a token, only the length of the range matters
+	if !m.Range.Empty() {
+		if !m.Range.Validate() {
+			return bbs.ThreadMessage{}, errors.New(fmt.Sprintf("Invalid range (%v)", m.Range))
+		}
+		if m.Token == "" {
+			start = max(m.Range.Start-1, 0)
+			stop = min(m.Range.End, len(posts))
 		} else {
-			messages = append(messages, bbs.Message{
-				ID:       strconv.Itoa(t.Number),
-				Author:   name(t),
-				AuthorID: t.ID,
-				Date:     t.Date,
-				Text:     text,
-			})
+			stop = min(start+m.Range.End-m.Range.Start+1, len(posts))
 		}
 	}
+	start = min(start, stop)
+
+	//bbs json out
+	var messages []bbs.Message
+	for i := range posts[start:stop] {
+		messages = append(messages, f.site.message(board, posts[start+i], m.Format))
+	}
+
+	// ranges are inclusive, so an empty one is the zero Range
+	var got bbs.Range
+	next := m.Token
+	if stop > start {
+		got = bbs.Range{Start: start + 1, End: stop}
+		next = strconv.Itoa(posts[stop-1].Number)
+	}
 
 	return bbs.ThreadMessage{
-		Command:  "msg",
-		ID:       m.ThreadID,
-		Title:    op.Subject,
-		Board:    board,
-		Format:   "html",
-		Messages: messages,
+		Command:   "msg",
+		ID:        id,
+		Title:     op.Subject,
+		Board:     board,
+		Format:    "html",
+		Closed:    op.Closed != 0 || op.Archived != 0,
+		Messages:  messages,
+		Filter:    m.Filter,
+		Range:     got,
+		Total:     len(posts),
+		More:      stop < len(posts),
+		NextToken: next,
 	}, nil
 }
 
 func (f *Fourchan) BoardList(m bbs.ListCommand) (blm bbs.BoardListMessage, err error) {
-	data, code := getBytes(boardListURL)
-	if code != 200 {
-		return bbs.BoardListMessage{}, errors.New(fmt.Sprintf("4chan error %d", code))
+	if f.site.Quirks.BoardList == "" {
+		return bbs.BoardListMessage{}, errors.New("This imageboard doesn't list its boards.")
 	}
 
 	var b = Boards{}
-	json.Unmarshal(data, &b)
+	if err := f.site.getJSON(f.site.boardListURL(), "Board list", &b); err != nil {
+		return bbs.BoardListMessage{}, err
+	}
 
 	var boards []bbs.BoardListing
 	for _, board := range b.List {
@@ -231,44 +251,29 @@ func (f *Fourchan) BoardList(m bbs.ListCommand) (blm bbs.BoardListMessage, err e
 }
 
 func (f *Fourchan) List(m bbs.ListCommand) (lm bbs.ListMessage, err error) {
-	data, code := getBytes(fmt.Sprintf(catalogURL, m.Query))
-	if code == 404 {
-		return bbs.ListMessage{}, errors.New(fmt.Sprintf("Board /%s/ not found.", m.Query))
-	} else if code != 200 {
-		return bbs.ListMessage{}, errors.New(fmt.Sprintf("4chan error %d", code))
+	q, err := parseQuery(m.Query)
+	if err != nil {
+		return bbs.ListMessage{}, err
+	}
+	// a token or range asks for pages of the index, with preview replies
+	if m.Token != "" || !m.Range.Empty() {
+		return f.site.index(q, m)
 	}
 
 	var c Catalog
-	json.Unmarshal(data, &c)
-
-	var threads []bbs.ThreadListing
+	if err := f.site.getJSON(f.site.catalogURL(q.board), fmt.Sprintf("Board /%s/", q.board), &c); err != nil {
+		return bbs.ListMessage{}, err
+	}
 
-	//turn this into bbs messages
+	var ops []*FourchanPost
 	for page := range c {
-		for i := range c[page].Threads {
-			t := c[page].Threads[i]
-
-			title := t.Subject
-			if title == "" {
-				title = summary(html.UnescapeString(t.Text))
-			}
-
-			thumb := fmt.Sprintf(thumbnailURL, m.Query, t.FileTime, t.FileExt)
-			if t.Spoiler != 0 {
-				thumb = spoilerImageURL
-			}
+		ops = append(ops, c[page].Threads...)
+	}
 
-			threads = append(threads, bbs.ThreadListing{
-				ID:           m.Query + ":" + strconv.Itoa(t.Number),
-				Title:        title,
-				Author:       name(t),
-				AuthorID:     t.ID,
-				Date:         t.Date,
-				PostCount:    t.Replies,
-				PictureURL:   fmt.Sprintf(imageURL, m.Query, t.FileTime, t.FileExt),
-				ThumbnailURL: thumb,
-			})
-		}
+	//turn this into bbs messages
+	var threads []bbs.ThreadListing
+	for _, t := range q.apply(ops) {
+		threads = append(threads, f.site.listing(q.board, t))
 	}
 
 	lm = bbs.ListMessage{
@@ -288,6 +293,167 @@ func (f *Fourchan) Post(m bbs.PostCommand) (pm bbs.OKMessage, err error) {
 	return bbs.OKMessage{}, readOnlyError
 }
 
+// message turns a 4chan post into a bbs message
+func (s *Site) message(board string, t *FourchanPost, format string) bbs.Message {
+	text := t.Text
+	if format == "text" {
+		text = unhtml(text)
+	}
+
+	msg := bbs.Message{
+		ID:          strconv.Itoa(t.Number),
+		Author:      name(t),
+		AuthorID:    t.ID,
+		AuthorTitle: authorTitle(t),
+		Date:        date(t),
+		Text:        s.fileInfo(board, t, format) + text,
+	}
+
+	if t.hasFile() {
+		msg.PictureURL = s.fileURL(board, t)
+		msg.ThumbnailURL = s.thumbnailURL(board, t)
+	}
+	return msg
+}
+
+// hasFile returns true if this post has a file that hasn't been deleted
+func (t *FourchanPost) hasFile() bool {
+	return t.FileTime != 0 && t.FileDeleted == 0
+}
+
+// date is when a post was made, as the imageboard shows it
+func date(t *FourchanPost) string {
+	if t.Date != "" {
+		return t.Date
+	}
+	// vichan doesn't send a formatted date
+	return time.Unix(int64(t.Timestamp), 0).UTC().Format("01/02/06(Mon)15:04:05")
+}
+
+// fileInfo is the line above a post describing its file, like 4chan shows
+func (s *Site) fileInfo(board string, t *FourchanPost, format string) string {
+	switch {
+	case t.FileDeleted != 0 && format == "text":
+		return "File deleted.\n"
+	case t.FileDeleted != 0:
+		return `<div class="file">File deleted.</div>`
+	case t.FileTime == 0:
+		return ""
+	}
+
+	filename := t.Filename + t.FileExt
+	details := fileSize(t.FileSize)
+	if t.Width != 0 && t.Height != 0 {
+		details += fmt.Sprintf(", %dx%d", t.Width, t.Height)
+	}
+	if t.Spoiler != 0 {
+		details += ", spoiler"
+	}
+	if format == "text" {
+		return fmt.Sprintf("File: %s (%s)\n", filename, details)
+	}
+	return fmt.Sprintf(`<div class="file" data-md5="%s" data-thumb-width="%d" data-thumb-height="%d">File: <a href="%s">%s</a> (%s)</div>`,
+		html.EscapeString(t.FileMD5), t.ThumbWidth, t.ThumbHeight,
+		s.fileURL(board, t), html.EscapeString(filename), details)
+}
+
+func fileSize(bytes int) string {
+	switch {
+	case bytes >= 1024*1024:
+		return fmt.Sprintf("%.2f MB", float64(bytes)/(1024*1024))
+	case bytes >= 1024:
+		return fmt.Sprintf("%d KB", bytes/1024)
+	}
+	return fmt.Sprintf("%d B", bytes)
+}
+
+// omitted says how much of a thread an index page leaves out, like 4chan does under the OP
+func omitted(t *FourchanPost) string {
+	if t.OmitedPosts == 0 {
+		return ""
+	}
+	text := plural(t.OmitedPosts, "post")
+	if t.OmittedImages != 0 {
+		text += " and " + plural(t.OmittedImages, "image")
+	}
+	return text + " omitted."
+}
+
+func plural(n int, what string) string {
+	if n == 1 {
+		return "1 " + what
+	}
+	return fmt.Sprintf("%d %ss", n, what)
+}
+
+// authorTitle shows where a poster is from and their email field (usually sage)
+func authorTitle(t *FourchanPost) string {
+	var title []string
+	if t.CountryName != "" {
+		title = append(title, t.CountryName)
+	}
+	if t.Email != "" {
+		title = append(title, t.Email)
+	}
+	return strings.Join(title, " · ")
+}
+
+// listing turns a thread's OP into a thread list entry
+func (s *Site) listing(board string, t *FourchanPost) bbs.ThreadListing {
+	title := t.Subject
+	if title == "" {
+		title = summary(html.UnescapeString(t.Text))
+	}
+
+	tl := bbs.ThreadListing{
+		ID:        board + ":" + strconv.Itoa(t.Number),
+		Title:     title,
+		Author:    name(t),
+		AuthorID:  t.ID,
+		Date:      date(t),
+		PostCount: t.Replies,
+		Sticky:    t.Sticky != 0,
+		Closed:    t.Closed != 0 || t.Archived != 0,
+	}
+
+	if t.hasFile() {
+		tl.PictureURL = s.fileURL(board, t)
+		tl.ThumbnailURL = s.thumbnailURL(board, t)
+	}
+	return tl
+}
+
+// posterFilter returns a function that matches the posts a get's filter asks for.
+// Filters look like:
+//
+//	op          posts by the OP (by ID or tripcode if the board has them, otherwise just the OP)
+//	trip:!abc   posts with the tripcode !abc
+//	id:XyZ123   posts with the poster ID XyZ123
+//	XyZ123      same as id:XyZ123, like ETI's user ID filter
+func posterFilter(filter string, op *FourchanPost) (func(*FourchanPost) bool, error) {
+	switch {
+	case filter == "op":
+		switch {
+		case op.ID != "":
+			return func(p *FourchanPost) bool { return p.ID == op.ID }, nil
+		case op.Tripcode != "":
+			return func(p *FourchanPost) bool { return p.Tripcode == op.Tripcode }, nil
+		}
+		return func(p *FourchanPost) bool { return p.Number == op.Number }, nil
+	case strings.HasPrefix(filter, "trip:"):
+		trip := strings.TrimPrefix(filter, "trip:")
+		if trip == "" {
+			return nil, errors.New("Invalid filter: " + filter)
+		}
+		return func(p *FourchanPost) bool { return p.Tripcode == trip }, nil
+	}
+	id := strings.TrimPrefix(filter, "id:")
+	if id == "" {
+		return nil, errors.New("Invalid filter: " + filter)
+	}
+	return func(p *FourchanPost) bool { return p.ID == id }, nil
+}
+
 // takes the first line of a thread's comment for when it has no title
 func summary(msg string) string {
 	msg = unhtml(msg)
@@ -337,13 +503,6 @@ func name(t *FourchanPost) string {
 	return username
 }
 
-func getBytes(url string) (b []byte, statusCode int) {
-	resp, _ := http.Get(url)
-	b, _ = ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	return b, resp.StatusCode
-}
-
 func stringToDocument(data string) *goquery.Document {
 	doc, err := html.Parse(strings.NewReader(data))
 	if err != nil {
@@ -352,6 +511,20 @@ func stringToDocument(data string) *goquery.Document {
 	return goquery.NewDocumentFromNode(doc)
 }
 
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func maybe(test string, def string) string {
 	if test == "" {
 		return def
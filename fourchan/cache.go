@@ -0,0 +1,105 @@
+package fourchan
+
+import (
+	"sync"
+	"time"
+
+	"github.com/guregu/relay/metrics"
+	"github.com/pmylund/go-cache"
+	"gopkg.in/mgo.v2"
+)
+
+var dbSesh *mgo.Session
+var db *mgo.Database
+
+// DB writes in progress, so Close can wait for them
+var writes sync.WaitGroup
+
+// responseCache is a site's cache of imageboard responses.
+type responseCache struct {
+	mem     *cache.Cache // map[url]*entry
+	persist bool         // also keep responses in the DB
+}
+
+// entry is a cached imageboard response.
+type entry struct {
+	URL          string `bson:"_id"`
+	Body         []byte
+	LastModified string
+	Fetched      time.Time
+}
+
+// EnableCache turns on this site's in-memory response cache.
+// If persist is true and we're connected to a DB (see DBConnect), responses are kept there too.
+// Cached responses are revalidated with If-Modified-Since, so they are never stale.
+func (s *Site) EnableCache(persist bool) {
+	s.cache = &responseCache{
+		mem:     cache.New(1*time.Hour, 10*time.Minute),
+		persist: persist,
+	}
+}
+
+// DBConnect persists cached responses to MongoDB, so they survive restarts.
+func DBConnect(addr, name string) {
+	if dbSesh != nil {
+		return
+	}
+	var err error
+	dbSesh, err = mgo.Dial(addr)
+	if err != nil {
+		log.Fatal("couldn't connect to cache", "addr", addr, "error", err)
+	}
+	db = dbSesh.DB(name)
+	log.Info("connected to cache", "addr", addr, "db", name)
+}
+
+// Close waits for pending cache writes and disconnects from the DB.
+func Close() {
+	writes.Wait()
+	if dbSesh != nil {
+		dbSesh.Close()
+		dbSesh, db = nil, nil
+	}
+}
+
+// lookup returns the cached response for url, or nil.
+// A nil cache has nothing in it.
+func (rc *responseCache) lookup(url string) *entry {
+	if rc == nil {
+		return nil
+	}
+
+	if e, ok := rc.mem.Get(url); ok {
+		metrics.Hit("imageboard_responses", true)
+		return e.(*entry)
+	}
+
+	if !rc.persist || db == nil {
+		metrics.Hit("imageboard_responses", false)
+		return nil
+	}
+	var e *entry
+	if err := db.C("responses").FindId(url).One(&e); err != nil {
+		metrics.Hit("imageboard_responses", false)
+		return nil
+	}
+	metrics.Hit("imageboard_responses", true)
+	rc.mem.Set(url, e, 0)
+	return e
+}
+
+// store caches a response. Storing in a nil cache does nothing.
+func (rc *responseCache) store(e entry) {
+	if rc == nil {
+		return
+	}
+
+	rc.mem.Set(e.URL, &e, 0)
+	if rc.persist && db != nil {
+		writes.Add(1)
+		go func() {
+			defer writes.Done()
+			db.C("responses").UpsertId(e.URL, e)
+		}()
+	}
+}
@@ -0,0 +1,65 @@
+package fourchan
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ErrorKind says what went wrong talking to an imageboard.
+type ErrorKind int
+
+const (
+	// NetworkError means we couldn't reach the site at all (DNS, timeouts, etc).
+	NetworkError ErrorKind = iota
+	// NotFoundError means the site said 404: the thread was pruned or the board doesn't exist.
+	NotFoundError
+	// ServerError means the site gave us a 5xx or some other status we didn't expect.
+	ServerError
+	// MalformedError means the site sent JSON we couldn't decode.
+	MalformedError
+)
+
+// Error is a failure talking to an imageboard. It's what bbs clients see as the error message.
+type Error struct {
+	Kind ErrorKind
+	What string // the thing we were looking for, like "Thread /g/123"
+	URL  string
+	Code int   // HTTP status code, if we got one
+	Err  error // underlying error, if there is one
+}
+
+func (e *Error) Error() string {
+	switch e.Kind {
+	case NetworkError:
+		return fmt.Sprintf("Couldn't reach %s: %v", e.host(), e.Err)
+	case NotFoundError:
+		return e.What + " not found."
+	case MalformedError:
+		return fmt.Sprintf("%s sent something we couldn't read: %v", e.host(), e.Err)
+	}
+	return fmt.Sprintf("%s error %d", e.host(), e.Code)
+}
+
+func (e *Error) host() string {
+	if u, err := url.Parse(e.URL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "imageboard"
+}
+
+// Temporary returns true if trying again later might work.
+func (e *Error) Temporary() bool {
+	return e.Kind == NetworkError || (e.Kind == ServerError && e.Code >= 500)
+}
+
+// statusError turns an unsuccessful status code into an error.
+func statusError(code int, what, url string) error {
+	switch {
+	case code == http.StatusOK:
+		return nil
+	case code == http.StatusNotFound:
+		return &Error{Kind: NotFoundError, What: what, URL: url, Code: code}
+	}
+	return &Error{Kind: ServerError, What: what, URL: url, Code: code}
+}
@@ -0,0 +1,125 @@
+package fourchan
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		code      int
+		ok        bool
+		kind      ErrorKind
+		temporary bool
+	}{
+		{http.StatusOK, true, 0, false},
+		{http.StatusNotFound, false, NotFoundError, false},
+		{http.StatusInternalServerError, false, ServerError, true},
+		{http.StatusServiceUnavailable, false, ServerError, true},
+		// not something trying again will fix
+		{http.StatusForbidden, false, ServerError, false},
+		{http.StatusTeapot, false, ServerError, false},
+	}
+	for _, test := range tests {
+		err := statusError(test.code, "Thread /g/123", "https://a.4cdn.org/g/thread/123.json")
+		if test.ok {
+			if err != nil {
+				t.Errorf("%d: got %v, want no error", test.code, err)
+			}
+			continue
+		}
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%d: got %#v, want an *Error", test.code, err)
+			continue
+		}
+		if e.Kind != test.kind || e.Code != test.code || e.Temporary() != test.temporary {
+			t.Errorf("%d: kind %v, code %d, temporary %v; want %v, %d, %v",
+				test.code, e.Kind, e.Code, e.Temporary(), test.kind, test.code, test.temporary)
+		}
+	}
+}
+
+// flaky serves status for the first fails requests, then body. It counts requests in calls.
+func flaky(calls *int32, fails, status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(atomic.AddInt32(calls, 1)) <= fails {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+}
+
+func TestRetry(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	tests := []struct {
+		name        string
+		fails       int
+		status      int
+		wantCalls   int32
+		wantStatus  int
+		wantHealthy bool
+	}{
+		{"ok", 0, 0, 1, http.StatusOK, true},
+		{"recovers", maxRetries - 1, http.StatusBadGateway, maxRetries, http.StatusOK, true},
+		{"gives up", maxRetries, http.StatusServiceUnavailable, maxRetries, http.StatusServiceUnavailable, false},
+		// trying again won't bring it back
+		{"not found", 1, http.StatusNotFound, 1, http.StatusNotFound, true},
+	}
+	for _, test := range tests {
+		var calls int32
+		srv := flaky(&calls, test.fails, test.status, "{}")
+		c := newClient(1000, 10)
+		_, _, code, err := c.retry(srv.URL, "")
+		srv.Close()
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if code != test.wantStatus || calls != test.wantCalls {
+			t.Errorf("%s: status %d after %d requests, want %d after %d", test.name, code, calls, test.wantStatus, test.wantCalls)
+		}
+		if healthy := c.lastErr == nil; healthy != test.wantHealthy {
+			t.Errorf("%s: last error %v", test.name, c.lastErr)
+		}
+	}
+}
+
+func TestGetJSONErrors(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	calls := make([]int32, 4)
+	notFound := flaky(&calls[0], 1, http.StatusNotFound, "")
+	defer notFound.Close()
+	down := flaky(&calls[1], maxRetries, http.StatusInternalServerError, "")
+	defer down.Close()
+	garbage := flaky(&calls[2], 0, 0, "<html>not json</html>")
+	defer garbage.Close()
+	gone := flaky(&calls[3], 0, 0, "")
+	gone.Close() // nobody's there
+
+	tests := []struct {
+		url  string
+		kind ErrorKind
+	}{
+		{notFound.URL, NotFoundError},
+		{down.URL, ServerError},
+		{garbage.URL, MalformedError},
+		{gone.URL, NetworkError},
+	}
+	for _, test := range tests {
+		s := &Site{client: newClient(1000, 10)}
+		var v struct{}
+		err := s.getJSON(test.url, "Thread /g/123", &v)
+		if e, ok := err.(*Error); !ok || e.Kind != test.kind {
+			t.Errorf("%s: got %#v, want kind %v", test.url, err, test.kind)
+		}
+	}
+}
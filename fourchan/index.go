@@ -0,0 +1,122 @@
+package fourchan
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/guregu/bbs"
+)
+
+// the most index pages one list command can ask for
+const maxIndexPages = 10
+
+// Index is one page of a board's index.
+type Index struct {
+	Threads []Thread `json:"threads"`
+}
+
+// index lists pages of a board's index in bump order, each thread followed by its preview replies.
+// The list command's token is the page to start at, and its range is which pages (counting from 1) to get.
+// With a token, only the length of the range matters, like Get.
+// The next page is the one after the last one asked for; asking past the end gets an empty list.
+//
+// Preview replies are listed like threads, right after their OP, with IDs like g:123#p456 (4chan's own post anchors).
+// If the page leaves some replies out, a g:123#omitted entry before them says how many.
+// Getting any of those gets the whole thread.
+func (s *Site) index(q query, m bbs.ListCommand) (bbs.ListMessage, error) {
+	first, last, err := indexPages(m)
+	if err != nil {
+		return bbs.ListMessage{}, err
+	}
+
+	var ops []*FourchanPost
+	previews := make(map[*FourchanPost][]*FourchanPost) // OP → its preview replies
+	for page := first; page <= last; page++ {
+		var idx Index
+		url := s.boardURL(q.board, page)
+		err := s.getJSON(url, fmt.Sprintf("Page %d of /%s/", page, q.board), &idx)
+		if e, ok := err.(*Error); ok && e.Kind == NotFoundError && page > 1 {
+			// past the last page
+			break
+		}
+		if err != nil {
+			return bbs.ListMessage{}, err
+		}
+		if len(idx.Threads) == 0 {
+			break
+		}
+
+		for _, t := range idx.Threads {
+			if len(t.Posts) == 0 {
+				continue
+			}
+			op := t.Posts[0]
+			previews[op] = t.Posts[1:]
+			ops = append(ops, op)
+		}
+	}
+
+	var threads []bbs.ThreadListing
+	for _, op := range q.apply(ops) {
+		threads = append(threads, s.listing(q.board, op))
+		if text := omitted(op); text != "" {
+			threads = append(threads, bbs.ThreadListing{
+				ID:    fmt.Sprintf("%s:%d#omitted", q.board, op.Number),
+				Title: text,
+			})
+		}
+		for _, p := range previews[op] {
+			threads = append(threads, s.preview(q.board, op, p))
+		}
+	}
+
+	return bbs.ListMessage{
+		Command: "list",
+		Type:    "thread",
+		Query:   m.Query,
+		Threads: threads,
+	}, nil
+}
+
+// preview turns a reply shown on an index page into a list entry under its thread
+func (s *Site) preview(board string, op, t *FourchanPost) bbs.ThreadListing {
+	tl := bbs.ThreadListing{
+		ID:       fmt.Sprintf("%s:%d#p%d", board, op.Number, t.Number),
+		Title:    summary(t.Text),
+		Author:   name(t),
+		AuthorID: t.ID,
+		Date:     date(t),
+	}
+	if t.hasFile() {
+		tl.PictureURL = s.fileURL(board, t)
+		tl.ThumbnailURL = s.thumbnailURL(board, t)
+	}
+	return tl
+}
+
+// indexPages figures out which index pages a list command wants.
+func indexPages(m bbs.ListCommand) (first, last int, err error) {
+	first, last = 1, 1
+	if m.Token != "" {
+		page, err := strconv.Atoi(m.Token)
+		if err != nil || page < 1 {
+			return 0, 0, errors.New("Invalid token: " + m.Token)
+		}
+		first, last = page, page
+	}
+	if !m.Range.Empty() {
+		if !m.Range.Validate() || m.Range.Start < 1 {
+			return 0, 0, errors.New(fmt.Sprintf("Invalid range (%v)", m.Range))
+		}
+		if m.Token == "" {
+			first, last = m.Range.Start, m.Range.End
+		} else {
+			last = first + m.Range.End - m.Range.Start
+		}
+	}
+	if last-first+1 > maxIndexPages {
+		last = first + maxIndexPages - 1
+	}
+	return first, last, nil
+}
@@ -0,0 +1,55 @@
+package fourchan
+
+import (
+	"testing"
+
+	"github.com/guregu/bbs"
+)
+
+func TestIndexPages(t *testing.T) {
+	tests := []struct {
+		token       string
+		rng         bbs.Range
+		first, last int
+		err         bool
+	}{
+		{"", bbs.Range{}, 1, 1, false},
+		{"3", bbs.Range{}, 3, 3, false},
+		{"", bbs.Range{Start: 2, End: 4}, 2, 4, false},
+		// with a token, only the length of the range matters
+		{"5", bbs.Range{Start: 1, End: 2}, 5, 6, false},
+		{"", bbs.Range{Start: 1, End: 50}, 1, maxIndexPages, false},
+		{"0", bbs.Range{}, 0, 0, true},
+		{"two", bbs.Range{}, 0, 0, true},
+		{"", bbs.Range{Start: 0, End: 2}, 0, 0, true},
+		{"", bbs.Range{Start: 3, End: 2}, 0, 0, true},
+	}
+	for _, test := range tests {
+		first, last, err := indexPages(bbs.ListCommand{Token: test.token, Range: test.rng})
+		if (err != nil) != test.err {
+			t.Errorf("token %q range %v: error = %v", test.token, test.rng, err)
+			continue
+		}
+		if first != test.first || last != test.last {
+			t.Errorf("token %q range %v: pages %d-%d, want %d-%d", test.token, test.rng, first, last, test.first, test.last)
+		}
+	}
+}
+
+func TestOmitted(t *testing.T) {
+	tests := []struct {
+		posts, images int
+		want          string
+	}{
+		{0, 0, ""},
+		{1, 0, "1 post omitted."},
+		{5, 1, "5 posts and 1 image omitted."},
+		{12, 3, "12 posts and 3 images omitted."},
+	}
+	for _, test := range tests {
+		op := &FourchanPost{OmitedPosts: test.posts, OmittedImages: test.images}
+		if got := omitted(op); got != test.want {
+			t.Errorf("omitted(%d, %d) = %q, want %q", test.posts, test.images, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package fourchan
+
+import (
+	"errors"
+	"html"
+	"sort"
+	"strings"
+)
+
+// query is a parsed thread list query.
+// Queries start with the board, followed by options and search terms:
+//
+//	g                        the catalog for /g/
+//	g sort:replies "linux"   /g/'s threads mentioning linux, most replies first
+//
+// Search terms are matched against the subject and comment, and all of them must match.
+// Use quotes to search for a phrase.
+type query struct {
+	board string
+	sort  string
+	terms []string // lowercase
+}
+
+// sort modes
+const (
+	sortBump    = "bump" // 4chan's order
+	sortDate    = "date" // newest first
+	sortReplies = "replies"
+	sortImages  = "images"
+)
+
+func parseQuery(q string) (query, error) {
+	fields, err := tokenize(q)
+	if err != nil {
+		return query{}, err
+	}
+	if len(fields) == 0 {
+		return query{}, errors.New("No board given.")
+	}
+
+	parsed := query{board: fields[0], sort: sortBump}
+	for _, f := range fields[1:] {
+		switch {
+		case strings.HasPrefix(f, "sort:"):
+			switch mode := strings.TrimPrefix(f, "sort:"); mode {
+			case sortBump, sortDate, sortReplies, sortImages:
+				parsed.sort = mode
+			default:
+				return query{}, errors.New("Invalid sort (try bump, date, replies, or images): " + mode)
+			}
+		default:
+			parsed.terms = append(parsed.terms, strings.ToLower(f))
+		}
+	}
+	return parsed, nil
+}
+
+// tokenize splits a query on spaces, keeping "quoted phrases" together.
+func tokenize(q string) ([]string, error) {
+	var fields []string
+	var cur []rune
+	quoted := false
+	flush := func() {
+		if len(cur) > 0 {
+			fields = append(fields, string(cur))
+			cur = nil
+		}
+	}
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			flush()
+		case r == ' ' && !quoted:
+			flush()
+		default:
+			cur = append(cur, r)
+		}
+	}
+	if quoted {
+		return nil, errors.New("Unclosed quote in query: " + q)
+	}
+	flush()
+	return fields, nil
+}
+
+// apply searches and sorts a list of threads (OPs).
+func (q query) apply(threads []*FourchanPost) []*FourchanPost {
+	if len(q.terms) > 0 {
+		var found []*FourchanPost
+		for _, t := range threads {
+			if q.matches(t) {
+				found = append(found, t)
+			}
+		}
+		threads = found
+	}
+
+	switch q.sort {
+	case sortDate:
+		sort.Stable(byDate(threads))
+	case sortReplies:
+		sort.Stable(byReplies(threads))
+	case sortImages:
+		sort.Stable(byImages(threads))
+	}
+	return threads
+}
+
+func (q query) matches(t *FourchanPost) bool {
+	text := strings.ToLower(html.UnescapeString(t.Subject) + "\n" + unhtml(t.Text))
+	for _, term := range q.terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+type byDate []*FourchanPost
+
+func (p byDate) Len() int           { return len(p) }
+func (p byDate) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byDate) Less(i, j int) bool { return p[i].Timestamp > p[j].Timestamp }
+
+type byReplies []*FourchanPost
+
+func (p byReplies) Len() int           { return len(p) }
+func (p byReplies) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byReplies) Less(i, j int) bool { return p[i].Replies > p[j].Replies }
+
+type byImages []*FourchanPost
+
+func (p byImages) Len() int           { return len(p) }
+func (p byImages) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byImages) Less(i, j int) bool { return p[i].Images > p[j].Images }
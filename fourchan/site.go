@@ -0,0 +1,215 @@
+package fourchan
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/guregu/bbs"
+)
+
+// Site is an imageboard that speaks 4chan's JSON API, or something close enough.
+// Each site is its own bbs server with its own Hello.
+type Site struct {
+	// Hello is what this site's sessions say hello with.
+	// Change it before serving.
+	Hello bbs.HelloMessage
+
+	// base URLs for the API, images, and static files (no trailing slash)
+	API    string
+	Images string
+	Static string
+	Quirks Quirks
+
+	client *client
+	cache  *responseCache // nil unless EnableCache is called
+}
+
+// Quirks describe where an imageboard keeps things, as paths relative to the base URLs.
+// Paths can use {board}, {thread}, {page}, {tim} and {ext}.
+type Quirks struct {
+	Thread    string
+	Page      string
+	Catalog   string
+	BoardList string // blank if the site can't list its boards
+	Image     string
+	Thumbnail string
+	Spoiler   string
+	FirstPage int // the number of the first index page
+}
+
+// Flavors are the imageboard software we know the quirks of.
+var Flavors = map[string]Quirks{
+	"4chan": {
+		Thread:    "/{board}/thread/{thread}.json",
+		Page:      "/{board}/{page}.json",
+		Catalog:   "/{board}/catalog.json",
+		BoardList: "/boards.json",
+		Image:     "/{board}/{tim}{ext}",
+		Thumbnail: "/{board}/{tim}s.jpg",
+		Spoiler:   "/image/spoiler.png",
+		FirstPage: 1,
+	},
+	// vichan, Tinyboard, and their forks
+	"vichan": {
+		Thread:    "/{board}/res/{thread}.json",
+		Page:      "/{board}/{page}.json",
+		Catalog:   "/{board}/catalog.json",
+		Image:     "/{board}/src/{tim}{ext}",
+		Thumbnail: "/{board}/thumb/{tim}{ext}",
+		Spoiler:   "/static/spoiler.png",
+		FirstPage: 0,
+	},
+}
+
+// NewSite creates an imageboard site of the given flavor.
+// Blank base URLs default to 4chan's, and images and static files default to the API's host for other flavors.
+func NewSite(flavor, api, images, static string) (*Site, error) {
+	flavor = maybe(flavor, "4chan")
+	quirks, ok := Flavors[flavor]
+	if !ok {
+		return nil, errors.New("unknown imageboard flavor: " + flavor)
+	}
+
+	if flavor == "4chan" {
+		api = maybe(api, DefaultAPIURL)
+		images = maybe(images, DefaultImageURL)
+		static = maybe(static, DefaultStaticURL)
+	} else if api == "" {
+		return nil, errors.New("imageboard needs an api URL: " + flavor)
+	}
+	api = strings.TrimSuffix(api, "/")
+
+	site := &Site{
+		API:    api,
+		Images: strings.TrimSuffix(maybe(images, api), "/"),
+		Static: strings.TrimSuffix(maybe(static, api), "/"),
+		Quirks: quirks,
+		Hello:  DefaultHello(),
+		client: clientFor(api),
+	}
+	if quirks.BoardList == "" {
+		site.Hello.Options = without(site.Hello.Options, "boards")
+		site.Hello.Lists = without(site.Hello.Lists, "board")
+	}
+	return site, nil
+}
+
+// Limit sets how many requests per second we make to this site,
+// and how many we can make at once after sitting idle.
+// Sites on the same host share a limit.
+func (s *Site) Limit(rate float64, burst int) {
+	if rate <= 0 {
+		rate = DefaultRate
+	}
+	if burst < 1 {
+		burst = DefaultBurst
+	}
+	s.client.bucket.set(rate, burst)
+}
+
+// Healthy returns an error if the last request to this site's host failed.
+func (s *Site) Healthy() error {
+	s.client.mu.Lock()
+	defer s.client.mu.Unlock()
+	return s.client.lastErr
+}
+
+// Close stops this site's thread watchers and empties its response cache,
+// for when it's no longer being served.
+func (s *Site) Close() {
+	s.unwatchAll()
+	if s.cache != nil {
+		s.cache.mem.Flush()
+	}
+}
+
+// New is this site's bbs.BBS factory, for bbs.NewServer.
+func (s *Site) New() bbs.BBS {
+	return &Fourchan{site: s}
+}
+
+// WithRealtimeURL returns a copy of the site that advertises a different realtime URL.
+// Everything else is shared with the original.
+func (s *Site) WithRealtimeURL(url string) *Site {
+	cp := *s
+	cp.Hello.RealtimeURL = url
+	return &cp
+}
+
+func (s *Site) path(tmpl, board, thread string, page int, t *FourchanPost) string {
+	r := []string{"{board}", board, "{thread}", thread, "{page}", strconv.Itoa(page)}
+	if t != nil {
+		r = append(r, "{tim}", strconv.FormatUint(uint64(t.FileTime), 10), "{ext}", t.FileExt)
+	}
+	return strings.NewReplacer(r...).Replace(tmpl)
+}
+
+func (s *Site) threadURL(board, id string) string {
+	return s.API + s.path(s.Quirks.Thread, board, id, 0, nil)
+}
+
+// boardURL is the URL of a page of a board's index, counting from 1.
+func (s *Site) boardURL(board string, page int) string {
+	return s.API + s.path(s.Quirks.Page, board, "", page-1+s.Quirks.FirstPage, nil)
+}
+
+func (s *Site) catalogURL(board string) string {
+	return s.API + s.path(s.Quirks.Catalog, board, "", 0, nil)
+}
+
+func (s *Site) boardListURL() string {
+	return s.API + s.Quirks.BoardList
+}
+
+func (s *Site) fileURL(board string, t *FourchanPost) string {
+	return s.Images + s.path(s.Quirks.Image, board, "", 0, t)
+}
+
+func (s *Site) thumbnailURL(board string, t *FourchanPost) string {
+	if t.Spoiler != 0 {
+		return s.Static + s.Quirks.Spoiler
+	}
+	return s.Images + s.path(s.Quirks.Thumbnail, board, "", 0, t)
+}
+
+// getJSON fetches url through the site's shared, rate-limited upstream client and decodes it into v.
+// what describes the thing we're getting, for error messages.
+func (s *Site) getJSON(url, what string, v interface{}) error {
+	data, code, err := s.client.get(url, s.cache)
+	if err != nil {
+		return &Error{Kind: NetworkError, What: what, URL: url, Err: err}
+	}
+	if err := statusError(code, what, url); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return &Error{Kind: MalformedError, What: what, URL: url, Code: code, Err: err}
+	}
+	return nil
+}
+
+// LooseInt is a number that might be sent as a string, like vichan's file times.
+type LooseInt uint64
+
+func (n *LooseInt) UnmarshalJSON(data []byte) error {
+	str := strings.Trim(string(data), `"`)
+	if str == "" || str == "null" {
+		*n = 0
+		return nil
+	}
+	i, err := strconv.ParseUint(str, 10, 64)
+	*n = LooseInt(i)
+	return err
+}
+
+func without(list []string, thing string) []string {
+	var ret []string
+	for _, s := range list {
+		if s != thing {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,234 @@
+package fourchan
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/guregu/relay/logger"
+	"github.com/guregu/relay/metrics"
+)
+
+var log = logger.With("backend", "imageboard")
+
+// 4chan asks API users to make no more than one request per second.
+// Other imageboards get the same courtesy by default.
+const (
+	DefaultRate  = 1.0
+	DefaultBurst = 1
+)
+
+const (
+	timeout    = 15 * time.Second
+	maxRetries = 3
+)
+
+// how long to wait before trying a failed request again, doubling every try
+var retryDelay = 1 * time.Second
+
+// map[api host]*client
+// every session on a site shares its client,
+// so the rate limit holds no matter how many people are browsing.
+var clients = struct {
+	sync.Mutex
+	m map[string]*client
+}{m: make(map[string]*client)}
+
+// clientFor returns the shared client for an API base URL.
+// Sites on the same host share a client (and a rate limit).
+func clientFor(api string) *client {
+	host := api
+	if u, err := url.Parse(api); err == nil && u.Host != "" {
+		host = u.Host
+	}
+
+	clients.Lock()
+	defer clients.Unlock()
+	c, ok := clients.m[host]
+	if !ok {
+		c = newClient(DefaultRate, DefaultBurst)
+		clients.m[host] = c
+	}
+	return c
+}
+
+type client struct {
+	http   *http.Client
+	bucket *bucket
+
+	mu       sync.Mutex
+	inflight map[callKey]*call
+	lastErr  error // how the last request went, for health checks
+}
+
+// callKey is what makes two gets the same request.
+// Sites sharing a client can have different caches (or none), so the cache is part of it.
+type callKey struct {
+	url   string
+	cache *responseCache
+}
+
+// call is a request that is in progress or finished.
+// Everyone asking for the same URL at the same time waits on the same call.
+type call struct {
+	wg   sync.WaitGroup
+	body []byte
+	code int
+	err  error
+}
+
+func newClient(rate float64, burst int) *client {
+	return &client{
+		http:     &http.Client{Transport: metrics.Transport{}, Timeout: timeout},
+		bucket:   newBucket(rate, burst),
+		inflight: make(map[callKey]*call),
+	}
+}
+
+// get fetches url, waiting for our turn in the queue.
+// Responses are cached in rc, which can be nil for no caching.
+// Concurrent gets of the same URL (and cache) are coalesced into one request.
+func (c *client) get(url string, rc *responseCache) (body []byte, statusCode int, err error) {
+	key := callKey{url, rc}
+	c.mu.Lock()
+	if cl, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		cl.wg.Wait()
+		return cl.body, cl.code, cl.err
+	}
+	cl := new(call)
+	cl.wg.Add(1)
+	c.inflight[key] = cl
+	c.mu.Unlock()
+
+	cl.body, cl.code, cl.err = c.load(url, rc)
+	cl.wg.Done()
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+
+	return cl.body, cl.code, cl.err
+}
+
+// load gets url from upstream, or from rc if upstream says it hasn't changed.
+func (c *client) load(url string, rc *responseCache) ([]byte, int, error) {
+	cached := rc.lookup(url)
+	var since string
+	if cached != nil {
+		since = cached.LastModified
+	}
+
+	body, lastModified, code, err := c.retry(url, since)
+	switch {
+	case err != nil:
+		return nil, 0, err
+	case code == http.StatusNotModified && cached != nil:
+		return cached.Body, http.StatusOK, nil
+	case code == http.StatusOK && lastModified != "":
+		rc.store(entry{
+			URL:          url,
+			Body:         body,
+			LastModified: lastModified,
+			Fetched:      time.Now(),
+		})
+	}
+	return body, code, nil
+}
+
+// retry fetches url, backing off and trying again if the site is down or unreachable.
+func (c *client) retry(url, since string) (body []byte, lastModified string, statusCode int, err error) {
+	defer func() {
+		c.mu.Lock()
+		c.lastErr = err
+		if err == nil && statusCode >= 500 {
+			c.lastErr = &Error{Kind: ServerError, URL: url, Code: statusCode}
+		}
+		c.mu.Unlock()
+	}()
+
+	delay := retryDelay
+	for try := 1; ; try++ {
+		body, lastModified, statusCode, err = c.fetch(url, since)
+		if err == nil && statusCode < 500 {
+			return
+		}
+		if try == maxRetries {
+			return
+		}
+		log.Warn("retrying", "url", url, "delay", delay, "status", statusCode, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// fetch makes a request upstream, conditional if since isn't blank.
+func (c *client) fetch(url, since string) (body []byte, lastModified string, statusCode int, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if since != "" {
+		req.Header.Set("If-Modified-Since", since)
+	}
+
+	c.bucket.wait()
+	log.Debug("fetching", "url", url)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	return body, resp.Header.Get("Last-Modified"), resp.StatusCode, err
+}
+
+// bucket is a token bucket rate limiter.
+// Waiters reserve tokens in the order they arrive, so it doubles as a queue.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	return &bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *bucket) set(rate float64, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate, b.burst = rate, float64(burst)
+	b.tokens = math.Min(b.tokens, b.burst)
+}
+
+// refill adds the tokens accrued since last time. b.mu must be held.
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait blocks until it's our turn to make a request.
+func (b *bucket) wait() {
+	b.mu.Lock()
+	b.refill(time.Now())
+	// tokens can go negative: that's the queue of people waiting ahead of us
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	time.Sleep(delay)
+}
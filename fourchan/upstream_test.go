@@ -0,0 +1,151 @@
+package fourchan
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBucketBurst(t *testing.T) {
+	b := newBucket(20, 3)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		b.wait()
+	}
+	if took := time.Since(start); took > 25*time.Millisecond {
+		t.Errorf("burst of 3 took %v, want no waiting", took)
+	}
+
+	// out of tokens: the next one waits for a refill (1/20th of a second)
+	start = time.Now()
+	b.wait()
+	if took := time.Since(start); took < 35*time.Millisecond {
+		t.Errorf("4th request took %v, want about 50ms", took)
+	}
+}
+
+func TestBucketQueue(t *testing.T) {
+	b := newBucket(50, 1)
+	b.wait() // use up the burst
+
+	// everyone waiting gets their own slot, 20ms apart
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.wait()
+		}()
+	}
+	wg.Wait()
+	if took := time.Since(start); took < 80*time.Millisecond {
+		t.Errorf("5 queued requests took %v, want about 100ms", took)
+	}
+}
+
+func TestBucketSet(t *testing.T) {
+	b := newBucket(1, 5)
+	b.set(1000, 2)
+	if b.tokens > 2 {
+		t.Errorf("tokens = %v after lowering the burst to 2", b.tokens)
+	}
+
+	b.wait()
+	b.wait()
+	start := time.Now()
+	b.wait()
+	if took := time.Since(start); took > 25*time.Millisecond {
+		t.Errorf("took %v at the new rate of 1000/s", took)
+	}
+}
+
+func TestClientCoalesces(t *testing.T) {
+	var hits int32
+	hit := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		select {
+		case hit <- struct{}{}:
+		default:
+		}
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	c := newClient(1000, 10)
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	get := func(i int) {
+		defer wg.Done()
+		body, code, err := c.get(srv.URL, nil)
+		if err != nil || code != http.StatusOK {
+			t.Errorf("get: %d %v", code, err)
+		}
+		bodies[i] = string(body)
+	}
+
+	wg.Add(1)
+	go get(0)
+	<-hit
+	for i := 1; i < len(bodies); i++ {
+		wg.Add(1)
+		go get(i)
+	}
+	// give them time to join the request in progress
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+	for i, body := range bodies {
+		if body != "ok" {
+			t.Errorf("get #%d got %q, want %q", i, body, "ok")
+		}
+	}
+}
+
+func TestClientCache(t *testing.T) {
+	const modified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	var conditional int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") == modified {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", modified)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	c := newClient(1000, 10)
+	site := &Site{client: c}
+	site.EnableCache(false)
+	for i := 0; i < 2; i++ {
+		body, code, err := c.get(srv.URL, site.cache)
+		if err != nil || code != http.StatusOK || string(body) != "ok" {
+			t.Fatalf("cached get #%d: %q %d %v", i, body, code, err)
+		}
+	}
+	if n := atomic.LoadInt32(&conditional); n != 1 {
+		t.Errorf("cached site revalidated %d times, want 1", n)
+	}
+
+	// a site without a cache shares the client, but never sees the other site's responses
+	atomic.StoreInt32(&conditional, 0)
+	if _, _, err := c.get(srv.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&conditional); n != 0 {
+		t.Errorf("uncached site revalidated %d times, want 0", n)
+	}
+}
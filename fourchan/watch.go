@@ -0,0 +1,398 @@
+package fourchan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+	"github.com/guregu/bbs"
+)
+
+// 4chan asks that threads be polled no more than every 10 seconds,
+// and less often when nothing is happening. We treat every imageboard that way.
+const (
+	minWatchInterval = 10 * time.Second
+	maxWatchInterval = 2 * time.Minute
+)
+
+// WatchHandler returns a websocket endpoint that pushes new posts in this site's watched threads.
+// It's mounted at <path>/watch, next to the realtime URL (<path>/ws).
+// It's a socket of its own because bbs's realtime socket only answers commands:
+// the library owns it, and a session has no way to send anything it wasn't asked for.
+//
+// Clients send:
+//
+//	{"cmd": "watch", "id": "g:12345", "token": "12399", "format": "text"}
+//	{"cmd": "unwatch", "id": "g:12345"}
+//
+// where token is the last post number the client has seen (optional).
+// The server sends "msg" messages containing only new posts,
+// with next_token set to the last post number.
+func (s *Site) WatchHandler() http.Handler {
+	return websocket.Handler(s.serveWatch)
+}
+
+// map[site and thread URL]*watcher
+var watchers = struct {
+	sync.Mutex
+	m map[watchKey]*watcher
+}{m: make(map[watchKey]*watcher)}
+
+// watchKey identifies a watcher. Each site has its own,
+// so closing a site doesn't hang up on another site's watchers of the same thread.
+type watchKey struct {
+	site *Site
+	url  string
+}
+
+// watcher polls one thread on behalf of everyone watching it.
+type watcher struct {
+	site  *Site
+	key   watchKey
+	board string
+	id    string
+	url   string
+
+	mu           sync.Mutex
+	subs         map[chan update]int // subscriber → last post they've been sent (or told us they'd seen)
+	posts        []*FourchanPost
+	last         int // last post number we've seen
+	lastModified string
+	stop         chan struct{}
+}
+
+// update is what a watcher sends to its subscribers
+type update struct {
+	board  string
+	posts  []*FourchanPost
+	closed bool
+	err    error
+}
+
+// watch subscribes to new posts in board:id that come after the post number last.
+func (s *Site) watch(board, id string, last int) (*watcher, chan update) {
+	url := s.threadURL(board, id)
+	key := watchKey{s, url}
+	// subscribe before letting go of watchers,
+	// so unwatch can't stop this watcher out from under us
+	watchers.Lock()
+	defer watchers.Unlock()
+	w, ok := watchers.m[key]
+	if !ok {
+		w = &watcher{
+			site:  s,
+			key:   key,
+			board: board,
+			id:    id,
+			url:   url,
+			subs:  make(map[chan update]int),
+			stop:  make(chan struct{}),
+		}
+		watchers.m[key] = w
+		go w.run()
+	}
+
+	ch := make(chan update, 16)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subs[ch] = last
+	// catch them up if they're behind what we've already seen
+	// if we haven't polled yet, the first poll will do it
+	if w.posts != nil {
+		if missed := after(w.posts, last); last > 0 && len(missed) > 0 {
+			ch <- update{board: board, posts: missed}
+		}
+		// polls only send what comes after this
+		if w.last > last {
+			w.subs[ch] = w.last
+		}
+	}
+	return w, ch
+}
+
+// unwatch unsubscribes ch, stopping the watcher if nobody is left.
+func (w *watcher) unwatch(ch chan update) {
+	watchers.Lock()
+	defer watchers.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.subs[ch]; !ok {
+		return
+	}
+	delete(w.subs, ch)
+	close(ch)
+	if len(w.subs) == 0 {
+		delete(watchers.m, w.key)
+		close(w.stop)
+	}
+}
+
+func (w *watcher) run() {
+	interval := minWatchInterval
+	for {
+		more, ok := w.poll()
+		if !ok {
+			return
+		}
+		if more {
+			interval = minWatchInterval
+		} else {
+			// nothing new, back off
+			interval = interval * 3 / 2
+			if interval > maxWatchInterval {
+				interval = maxWatchInterval
+			}
+		}
+
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// poll checks the thread for new posts and sends them out.
+// It returns whether there were any, and false for ok when we should stop watching.
+func (w *watcher) poll() (more bool, ok bool) {
+	body, lastModified, code, err := w.site.client.retry(w.url, w.lastModified)
+	if err == nil {
+		err = statusError(code, fmt.Sprintf("Thread /%s/%s", w.board, w.id), w.url)
+	}
+	switch {
+	case code == http.StatusNotModified:
+		return false, true
+	case err != nil:
+		if e, ok := err.(*Error); ok && e.Kind == NotFoundError {
+			// thread's gone
+			w.broadcast(update{board: w.board, closed: true, err: err})
+			w.shutdown()
+			return false, false
+		}
+		log.Warn("couldn't poll watched thread", "url", w.url, "error", err)
+		return false, true
+	}
+
+	var t Thread
+	if err := json.Unmarshal(body, &t); err != nil {
+		log.Warn("couldn't poll watched thread", "url", w.url, "error", err)
+		return false, true
+	}
+	if len(t.Posts) == 0 {
+		return false, true
+	}
+
+	closed := t.Posts[0].Closed != 0 || t.Posts[0].Archived != 0
+	w.mu.Lock()
+	w.lastModified = lastModified
+	// the first poll just tells us where we are
+	more = w.posts != nil && len(after(t.Posts, w.last)) > 0
+	w.posts = t.Posts
+	w.last = t.Posts[len(t.Posts)-1].Number
+	w.send(closed)
+	w.mu.Unlock()
+
+	if closed {
+		w.shutdown()
+		return false, false
+	}
+	return more, true
+}
+
+// send gives each subscriber the posts they haven't been sent yet. w.mu must be held.
+// Subscribers who didn't tell us where they were start from here.
+func (w *watcher) send(closed bool) {
+	for ch, last := range w.subs {
+		var posts []*FourchanPost
+		if last != 0 {
+			posts = after(w.posts, last)
+		}
+		if w.last > last {
+			w.subs[ch] = w.last
+		}
+		if len(posts) == 0 && !closed {
+			continue
+		}
+		select {
+		case ch <- update{board: w.board, posts: posts, closed: closed}:
+		default:
+			log.Warn("dropping watch update for slow client", "url", w.url)
+		}
+	}
+}
+
+func (w *watcher) broadcast(u update) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.subs {
+		select {
+		case ch <- u:
+		default:
+			log.Warn("dropping watch update for slow client", "url", w.url)
+		}
+	}
+}
+
+// shutdown stops watching and hangs up on every subscriber.
+func (w *watcher) shutdown() {
+	watchers.Lock()
+	defer watchers.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if watchers.m[w.key] == w {
+		delete(watchers.m, w.key)
+		close(w.stop)
+	}
+	for ch := range w.subs {
+		delete(w.subs, ch)
+		close(ch)
+	}
+}
+
+// unwatchAll shuts down all of this site's watchers.
+func (s *Site) unwatchAll() {
+	var ws []*watcher
+	watchers.Lock()
+	for key, w := range watchers.m {
+		if key.site == s {
+			ws = append(ws, w)
+		}
+	}
+	watchers.Unlock()
+
+	for _, w := range ws {
+		w.shutdown()
+	}
+}
+
+// after returns the posts numbered higher than last.
+func after(posts []*FourchanPost, last int) []*FourchanPost {
+	for i, p := range posts {
+		if p.Number > last {
+			return posts[i:]
+		}
+	}
+	return nil
+}
+
+type watchCommand struct {
+	Command  string `json:"cmd"`
+	ThreadID string `json:"id"`
+	Token    string `json:"token,omitempty"`
+	Format   string `json:"format,omitempty"`
+}
+
+type watchError struct {
+	Command string `json:"cmd"`
+	ReplyTo string `json:"wrt"`
+	Error   string `json:"error"`
+}
+
+type subscription struct {
+	w  *watcher
+	ch chan update
+}
+
+func (s *Site) serveWatch(ws *websocket.Conn) {
+	var sendLock sync.Mutex
+	send := func(v interface{}) {
+		sendLock.Lock()
+		defer sendLock.Unlock()
+		if err := websocket.JSON.Send(ws, v); err != nil {
+			log.Debug("couldn't send watch update", "error", err)
+		}
+	}
+
+	var mu sync.Mutex // guards subs
+	subs := make(map[string]subscription)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, sub := range subs {
+			sub.w.unwatch(sub.ch)
+		}
+	}()
+	// done forgets a subscription once its watcher hangs up (the thread 404'd or closed),
+	// so the client can watch it again
+	done := func(id string, ch chan update) {
+		mu.Lock()
+		defer mu.Unlock()
+		if sub, ok := subs[id]; ok && sub.ch == ch {
+			delete(subs, id)
+		}
+	}
+
+	for {
+		var cmd watchCommand
+		if err := websocket.JSON.Receive(ws, &cmd); err != nil {
+			return
+		}
+
+		switch cmd.Command {
+		case "watch":
+			split := strings.Split(cmd.ThreadID, ":")
+			if len(split) != 2 {
+				send(watchError{"error", "watch", "Invalid Thread ID: " + cmd.ThreadID})
+				continue
+			}
+			mu.Lock()
+			if _, ok := subs[cmd.ThreadID]; ok {
+				mu.Unlock()
+				continue
+			}
+			last, _ := strconv.Atoi(cmd.Token)
+			w, ch := s.watch(split[0], split[1], last)
+			subs[cmd.ThreadID] = subscription{w, ch}
+			mu.Unlock()
+			go func(cmd watchCommand) {
+				s.forward(cmd, ch, send)
+				done(cmd.ThreadID, ch)
+			}(cmd)
+		case "unwatch":
+			mu.Lock()
+			sub, ok := subs[cmd.ThreadID]
+			delete(subs, cmd.ThreadID)
+			mu.Unlock()
+			if ok {
+				sub.w.unwatch(sub.ch)
+			}
+		default:
+			send(watchError{"error", cmd.Command, "Unknown command: " + cmd.Command})
+		}
+	}
+}
+
+// forward sends updates for one subscription down the websocket until it's unwatched
+// or the watcher hangs up.
+func (s *Site) forward(cmd watchCommand, ch chan update, send func(interface{})) {
+	for u := range ch {
+		if u.err != nil {
+			send(watchError{"error", "watch", u.err.Error()})
+			continue
+		}
+		msg := bbs.ThreadMessage{
+			Command: "msg",
+			ID:      cmd.ThreadID,
+			Board:   u.board,
+			Format:  "html",
+			Closed:  u.closed,
+		}
+		if cmd.Format == "text" {
+			msg.Format = "text"
+		}
+		for _, p := range u.posts {
+			msg.Messages = append(msg.Messages, s.message(u.board, p, cmd.Format))
+		}
+		if len(u.posts) > 0 {
+			msg.NextToken = strconv.Itoa(u.posts[len(u.posts)-1].Number)
+		}
+		send(msg)
+	}
+}
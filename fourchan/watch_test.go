@@ -0,0 +1,90 @@
+package fourchan
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeThread serves a thread with posts numbered 1 to n, holding the first request until release is closed.
+type fakeThread struct {
+	mu      sync.Mutex
+	n       int
+	release chan struct{}
+	once    sync.Once
+}
+
+func (ft *fakeThread) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ft.once.Do(func() { <-ft.release })
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	var posts []string
+	for i := 1; i <= ft.n; i++ {
+		posts = append(posts, fmt.Sprintf(`{"no": %d, "resto": 1, "now": "", "time": 0}`, i))
+	}
+	fmt.Fprintf(w, `{"posts": [%s]}`, strings.Join(posts, ","))
+}
+
+// numbers are the post numbers in everything waiting in ch.
+func numbers(ch chan update) []int {
+	var got []int
+	for {
+		select {
+		case u, ok := <-ch:
+			if !ok {
+				return got
+			}
+			for _, p := range u.posts {
+				got = append(got, p.Number)
+			}
+		case <-time.After(50 * time.Millisecond):
+			return got
+		}
+	}
+}
+
+func TestWatchSendsOnce(t *testing.T) {
+	ft := &fakeThread{n: 3, release: make(chan struct{})}
+	srv := httptest.NewServer(ft)
+	defer srv.Close()
+	s, err := NewSite("4chan", srv.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Limit(1000, 10)
+	defer s.unwatchAll()
+
+	// these join before the first poll: one knows where they were, one doesn't
+	w, behind := s.watch("g", "1", 1)
+	_, fresh := s.watch("g", "1", 0)
+	close(ft.release)
+	if got := numbers(behind); !reflect.DeepEqual(got, []int{2, 3}) {
+		t.Errorf("subscriber at 1 got %v on the first poll, want [2 3]", got)
+	}
+	if got := numbers(fresh); got != nil {
+		t.Errorf("subscriber without a token got %v on the first poll, want nothing", got)
+	}
+
+	// this one joins after
+	_, late := s.watch("g", "1", 1)
+	if got := numbers(late); !reflect.DeepEqual(got, []int{2, 3}) {
+		t.Errorf("late subscriber at 1 got %v, want [2 3]", got)
+	}
+
+	ft.mu.Lock()
+	ft.n = 4
+	ft.mu.Unlock()
+	if more, ok := w.poll(); !more || !ok {
+		t.Errorf("poll = %v, %v; want new posts", more, ok)
+	}
+	for name, ch := range map[string]chan update{"behind": behind, "fresh": fresh, "late": late} {
+		if got := numbers(ch); !reflect.DeepEqual(got, []int{4}) {
+			t.Errorf("%s got %v after post 4, want [4]", name, got)
+		}
+	}
+}
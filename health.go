@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/guregu/bbs"
+	"github.com/guregu/relay/logger"
+	"github.com/guregu/relay/metrics"
+)
+
+// endpoints for monitoring, which sites can't be mounted over
+var monitoringPaths = []string{"/healthz", "/readyz", "/metrics"}
+
+var (
+	commandCount = metrics.NewCounter("relay_commands_total",
+		"Commands handled, by backend, site, command and result (ok or error).",
+		"backend", "site", "command", "result")
+	commandDuration = metrics.NewHistogram("relay_command_duration_seconds",
+		"How long commands took, by backend, site and command.",
+		metrics.DefaultBuckets, "backend", "site", "command")
+	wsSessions = metrics.NewGauge("relay_websocket_sessions",
+		"Open websocket sessions, by path.",
+		"path")
+)
+
+var errLoginFailed = errors.New("login failed")
+
+// healthz says we're up.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz says whether every site's upstream and cache are working,
+// with 503 Service Unavailable and a list of problems if not.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	var problems []string
+	for _, relay := range sites.current() {
+		if err := relay.handler.health(); err != nil {
+			problems = append(problems, relay.Path+": "+err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, p := range problems {
+			fmt.Fprintln(w, p)
+		}
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// instrument wraps a bbs.BBS factory so its sessions count and time their commands.
+// Sessions keep their board and bookmark lists, if they have them.
+func instrument(backend, site string, new func() bbs.BBS) func() bbs.BBS {
+	return func() bbs.BBS {
+		b := new()
+		i := &instrumented{BBS: b, backend: backend, site: site}
+		_, boards := b.(boardLister)
+		_, bookmarks := b.(bookmarkLister)
+		switch {
+		case boards && bookmarks:
+			return instrumentedBoth{i}
+		case boards:
+			return instrumentedBoards{i}
+		case bookmarks:
+			return instrumentedBookmarks{i}
+		}
+		return i
+	}
+}
+
+type boardLister interface {
+	BoardList(m bbs.ListCommand) (bbs.BoardListMessage, error)
+}
+
+type bookmarkLister interface {
+	BookmarkList(m bbs.ListCommand) (bbs.BookmarkListMessage, error)
+}
+
+type instrumented struct {
+	bbs.BBS
+	backend string
+	site    string
+	user    string // who logged in, for logs
+	reqID   string // for websocket sessions, which are all one request
+}
+
+// requestIDSetter is a session that can be told which request it belongs to.
+type requestIDSetter interface {
+	setRequestID(id string)
+}
+
+// withRequestID tells b the request it belongs to, if it wants to know.
+func withRequestID(b bbs.BBS, id string) bbs.BBS {
+	if s, ok := b.(requestIDSetter); ok {
+		s.setRequestID(id)
+	}
+	return b
+}
+
+func (i *instrumented) setRequestID(id string) {
+	i.reqID = id
+}
+
+// requestID is the ID of the request a command for session (or from username, logging in) came in on.
+func (i *instrumented) requestID(session, username string) string {
+	if i.reqID != "" {
+		return i.reqID
+	}
+	return commandID(commandKey(i.site, session, username))
+}
+
+// observe records and logs a command that came in on request reqID and started at start. Call it deferred.
+func (i *instrumented) observe(cmd, reqID string, start time.Time, err *error) {
+	took := time.Since(start)
+	log := logger.With("req_id", reqID, "backend", i.backend, "site", i.site, "user", i.user, "command", cmd, "duration", took)
+	result := "ok"
+	if err != nil && *err != nil {
+		result = "error"
+		log.Warn("command failed", "error", *err)
+	} else {
+		log.Debug("command")
+	}
+	commandCount.Inc(i.backend, i.site, cmd, result)
+	commandDuration.Observe(took.Seconds(), i.backend, i.site, cmd)
+}
+
+func (i *instrumented) Register(m bbs.RegisterCommand) (okm bbs.OKMessage, err error) {
+	defer i.observe("register", i.requestID("", m.Username), time.Now(), &err)
+	return i.BBS.Register(m)
+}
+
+func (i *instrumented) LogIn(m bbs.LoginCommand) bool {
+	var err error
+	defer i.observe("login", i.requestID("", m.Username), time.Now(), &err)
+	ok := i.BBS.LogIn(m)
+	if ok {
+		i.user = m.Username
+	} else {
+		err = errLoginFailed
+	}
+	return ok
+}
+
+func (i *instrumented) LogOut(m bbs.LogoutCommand) bbs.OKMessage {
+	defer func() { i.user = "" }()
+	defer i.observe("logout", i.requestID(m.Session, ""), time.Now(), nil)
+	return i.BBS.LogOut(m)
+}
+
+func (i *instrumented) Get(m bbs.GetCommand) (tm bbs.ThreadMessage, err error) {
+	defer i.observe("get", i.requestID(m.Session, ""), time.Now(), &err)
+	return i.BBS.Get(m)
+}
+
+func (i *instrumented) List(m bbs.ListCommand) (lm bbs.ListMessage, err error) {
+	defer i.observe("list", i.requestID(m.Session, ""), time.Now(), &err)
+	return i.BBS.List(m)
+}
+
+func (i *instrumented) Reply(m bbs.ReplyCommand) (okm bbs.OKMessage, err error) {
+	defer i.observe("reply", i.requestID(m.Session, ""), time.Now(), &err)
+	return i.BBS.Reply(m)
+}
+
+func (i *instrumented) Post(m bbs.PostCommand) (okm bbs.OKMessage, err error) {
+	defer i.observe("post", i.requestID(m.Session, ""), time.Now(), &err)
+	return i.BBS.Post(m)
+}
+
+func (i *instrumented) boardList(m bbs.ListCommand) (blm bbs.BoardListMessage, err error) {
+	defer i.observe("list board", i.requestID(m.Session, ""), time.Now(), &err)
+	return i.BBS.(boardLister).BoardList(m)
+}
+
+func (i *instrumented) bookmarkList(m bbs.ListCommand) (bmm bbs.BookmarkListMessage, err error) {
+	defer i.observe("list bookmark", i.requestID(m.Session, ""), time.Now(), &err)
+	return i.BBS.(bookmarkLister).BookmarkList(m)
+}
+
+type instrumentedBoards struct{ *instrumented }
+
+func (i instrumentedBoards) BoardList(m bbs.ListCommand) (bbs.BoardListMessage, error) {
+	return i.boardList(m)
+}
+
+type instrumentedBookmarks struct{ *instrumented }
+
+func (i instrumentedBookmarks) BookmarkList(m bbs.ListCommand) (bbs.BookmarkListMessage, error) {
+	return i.bookmarkList(m)
+}
+
+type instrumentedBoth struct{ *instrumented }
+
+func (i instrumentedBoth) BoardList(m bbs.ListCommand) (bbs.BoardListMessage, error) {
+	return i.boardList(m)
+}
+
+func (i instrumentedBoth) BookmarkList(m bbs.ListCommand) (bbs.BookmarkListMessage, error) {
+	return i.bookmarkList(m)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/guregu/bbs"
+	"github.com/guregu/relay/logger"
+	"github.com/zenazn/goji/web"
+)
+
+const version = "relay 0.3"
+
+// listing is a server in index.json
+type listing struct {
+	Path    string           `json:"path"`
+	Hello   bbs.HelloMessage `json:"hello"`
+	Status  string           `json:"status"` // "ok" or "error"
+	Error   string           `json:"error,omitempty"`
+	Version string           `json:"version"`
+}
+
+func listings(r *http.Request) []listing {
+	var list []listing
+	for _, relay := range sites.current() {
+		l := listing{
+			Path:    relay.Path,
+			Hello:   relay.handler.hello(r),
+			Status:  "ok",
+			Version: version,
+		}
+		if err := relay.handler.health(); err != nil {
+			l.Status = "error"
+			l.Error = err.Error()
+		}
+		list = append(list, l)
+	}
+	return list
+}
+
+// for index.json, which lists all our servers.
+// ?format=opml or ?format=html for something other than JSON.
+func indexHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	list := listings(r)
+	var err error
+	switch r.URL.Query().Get("format") {
+	case "opml":
+		w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+		err = writeOPML(w, r, list)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = indexTemplate.Execute(w, list)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(list)
+	}
+	if err != nil {
+		logger.Warn("couldn't write index", "format", r.URL.Query().Get("format"), "error", err)
+	}
+}
+
+type opml struct {
+	XMLName  xml.Name      `xml:"opml"`
+	Version  string        `xml:"version,attr"`
+	Title    string        `xml:"head>title"`
+	Created  string        `xml:"head>dateCreated"`
+	Outlines []opmlOutline `xml:"body>outline"`
+}
+
+type opmlOutline struct {
+	Text        string `xml:"text,attr"`
+	Description string `xml:"description,attr,omitempty"`
+	Type        string `xml:"type,attr"`
+	URL         string `xml:"url,attr"`
+}
+
+func writeOPML(w http.ResponseWriter, r *http.Request, list []listing) error {
+	server := currentConfig().Server
+	scheme := "http://"
+	if server.secure() {
+		scheme = "https://"
+	}
+	host := server.Host
+	if o, ok := forwardedOrigin(r); ok {
+		host = o.host
+		if o.secure {
+			scheme = "https://"
+		} else {
+			scheme = "http://"
+		}
+	}
+
+	doc := opml{
+		Version: "2.0",
+		Title:   version,
+		Created: time.Now().UTC().Format(time.RFC1123Z),
+	}
+	for _, l := range list {
+		doc.Outlines = append(doc.Outlines, opmlOutline{
+			Text:        l.Hello.Name,
+			Description: l.Hello.Description,
+			Type:        "link",
+			URL:         scheme + host + l.Path,
+		})
+	}
+
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(doc)
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>relay</title></head>
+<body>
+<h1>relay</h1>
+<ul>
+{{range .}}<li class="{{.Status}}">
+	{{if .Hello.IconURL}}<img src="{{.Hello.IconURL}}" alt="" width="16" height="16"> {{end}}<a href="{{.Path}}">{{.Hello.Name}}</a> — {{.Hello.Description}}
+	{{if .Error}}<em>({{.Error}})</em>{{end}}
+	<br><small>{{range .Hello.Options}}{{.}} {{end}}</small>
+</li>
+{{end}}</ul>
+</body>
+</html>
+`))
@@ -0,0 +1,238 @@
+// Package logger writes leveled, structured logs as logfmt or JSON.
+// Passwords, cookies and session tokens are redacted before anything is written,
+// so logs are safe to ship elsewhere.
+//
+// Log lines are a message and key/value pairs:
+//
+//	logger.Info("logged in", "backend", "eti", "user", name)
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is how important a log line is.
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name: debug, info, warn or error.
+// Blank means info.
+func ParseLevel(s string) (Level, error) {
+	if s == "" {
+		return InfoLevel, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, errors.New("unknown log level: " + s)
+}
+
+// Format is how log lines are written.
+type Format int
+
+const (
+	Logfmt Format = iota // key=value pairs
+	JSON                 // one object per line
+)
+
+// ParseFormat parses a format name: logfmt or json.
+// Blank means logfmt.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "", "logfmt":
+		return Logfmt, nil
+	case "json":
+		return JSON, nil
+	}
+	return 0, errors.New("unknown log format: " + s)
+}
+
+var out = struct {
+	sync.Mutex
+	w      io.Writer
+	level  Level
+	format Format
+}{w: os.Stderr, level: InfoLevel}
+
+// Configure sets the format and minimum level of log lines.
+// It also takes over the standard library's logger,
+// so libraries that use it are formatted (and redacted) the same way.
+func Configure(format Format, level Level) {
+	out.Lock()
+	out.format, out.level = format, level
+	out.Unlock()
+
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(stdWriter{})
+}
+
+// SetOutput changes where logs go. It's stderr by default.
+func SetOutput(w io.Writer) {
+	out.Lock()
+	out.w = w
+	out.Unlock()
+}
+
+// Logger adds its fields to every line it writes.
+type Logger struct {
+	fields []interface{}
+}
+
+var root = &Logger{}
+
+// With returns a logger that adds these key/value pairs to every line.
+func With(kv ...interface{}) *Logger {
+	return root.With(kv...)
+}
+
+// With returns a logger with these key/value pairs added to this one's.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{fields: fields}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.write(DebugLevel, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.write(InfoLevel, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.write(WarnLevel, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.write(ErrorLevel, msg, kv) }
+
+// Fatal logs an error and exits.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.write(ErrorLevel, msg, kv)
+	os.Exit(1)
+}
+
+func Debug(msg string, kv ...interface{}) { root.write(DebugLevel, msg, kv) }
+func Info(msg string, kv ...interface{})  { root.write(InfoLevel, msg, kv) }
+func Warn(msg string, kv ...interface{})  { root.write(WarnLevel, msg, kv) }
+func Error(msg string, kv ...interface{}) { root.write(ErrorLevel, msg, kv) }
+
+// Fatal logs an error and exits.
+func Fatal(msg string, kv ...interface{}) {
+	root.write(ErrorLevel, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) write(level Level, msg string, kv []interface{}) {
+	out.Lock()
+	defer out.Unlock()
+	if level < out.level {
+		return
+	}
+
+	pairs := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	pairs = append(pairs,
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"msg", redactString(msg))
+	pairs = append(pairs, l.fields...)
+	pairs = append(pairs, kv...)
+	if len(pairs)%2 != 0 {
+		pairs = append(pairs, "(missing)")
+	}
+
+	var buf bytes.Buffer
+	switch out.format {
+	case JSON:
+		writeJSON(&buf, pairs)
+	default:
+		writeLogfmt(&buf, pairs)
+	}
+	buf.WriteByte('\n')
+	out.w.Write(buf.Bytes())
+}
+
+func writeLogfmt(buf *bytes.Buffer, pairs []interface{}) {
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		key := fmt.Sprint(pairs[i])
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		v := fmt.Sprint(value(key, pairs[i+1]))
+		if v == "" || strings.ContainsAny(v, " =\"\t\r\n") {
+			v = strconv.Quote(v)
+		}
+		buf.WriteString(v)
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, pairs []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key := fmt.Sprint(pairs[i])
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		val := value(key, pairs[i+1])
+		v, err := json.Marshal(val)
+		if err != nil {
+			// NaN and such
+			v, _ = json.Marshal(fmt.Sprint(val))
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+}
+
+// value turns v into something printable, redacting it if it's secret.
+func value(key string, v interface{}) interface{} {
+	if sensitiveKey(key) {
+		return redacted
+	}
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return redactString(x)
+	case error:
+		return redactString(x.Error())
+	case fmt.Stringer:
+		return redactString(x.String())
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return x
+	}
+	return redactString(fmt.Sprint(v))
+}
+
+// stdWriter sends the standard library's log lines through us.
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	root.write(InfoLevel, strings.TrimSpace(string(p)), []interface{}{"source", "log"})
+	return len(p), nil
+}
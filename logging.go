@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/guregu/relay/logger"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+	"github.com/zenazn/goji/web/mutil"
+)
+
+// map[request being served]request ID, for handlers that don't get goji's context
+var requestIDs = struct {
+	sync.Mutex
+	m map[*http.Request]string
+}{m: make(map[*http.Request]string)}
+
+// logRequests is middleware that logs every request with its request ID.
+// It replaces goji's logger. Only the path is logged: query strings can have secrets in them.
+func logRequests(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := middleware.GetReqID(*c)
+		requestIDs.Lock()
+		requestIDs.m[r] = id
+		requestIDs.Unlock()
+		defer func() {
+			requestIDs.Lock()
+			delete(requestIDs.m, r)
+			requestIDs.Unlock()
+		}()
+
+		lw := mutil.WrapWriter(w)
+		h.ServeHTTP(lw, r)
+		status := lw.Status()
+		if status == 0 {
+			// hijacked (websockets) or nothing written
+			status = http.StatusOK
+		}
+		logger.Info("request",
+			"req_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote", r.RemoteAddr,
+			"status", status,
+			"duration", time.Since(start))
+	})
+}
+
+// requestID returns the ID of a request being served, or blank.
+func requestID(r *http.Request) string {
+	requestIDs.Lock()
+	defer requestIDs.Unlock()
+	return requestIDs.m[r]
+}
+
+// map[site and session]HTTP commands in progress
+// bbs keeps a session's BBS between requests, so its commands can't be told which request they're part of.
+// Instead, siteHandler notes each command's request ID here by the session it's for,
+// and instrumented sessions look it up when they log.
+var commandIDs = struct {
+	sync.Mutex
+	m map[string]*pendingCommand
+}{m: make(map[string]*pendingCommand)}
+
+type pendingCommand struct {
+	id string // blank if there's more than one, since we can't tell whose is whose
+	n  int
+}
+
+// beginCommand notes that request id is running a command under key. Call the returned func when it's done.
+func beginCommand(key, id string) (done func()) {
+	commandIDs.Lock()
+	defer commandIDs.Unlock()
+	pc, ok := commandIDs.m[key]
+	if ok {
+		pc.id = ""
+	} else {
+		pc = &pendingCommand{id: id}
+		commandIDs.m[key] = pc
+	}
+	pc.n++
+
+	return func() {
+		commandIDs.Lock()
+		defer commandIDs.Unlock()
+		pc.n--
+		if pc.n == 0 {
+			delete(commandIDs.m, key)
+		}
+	}
+}
+
+// commandID returns the request ID of the command in progress under key, or blank.
+func commandID(key string) string {
+	commandIDs.Lock()
+	defer commandIDs.Unlock()
+	if pc, ok := commandIDs.m[key]; ok {
+		return pc.id
+	}
+	return ""
+}
+
+// commandKey is what HTTP commands are noted under: the site and the session (or who's logging in).
+func commandKey(site, session, username string) string {
+	if session == "" && username != "" {
+		return site + " user " + username
+	}
+	return site + " session " + session
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Transport is an http.RoundTripper that counts upstream responses in UpstreamResponses.
+// A nil RoundTripper means http.DefaultTransport.
+type Transport struct {
+	http.RoundTripper
+}
+
+func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	resp, err := rt.RoundTrip(req)
+	code := 0
+	if err == nil {
+		code = resp.StatusCode
+	}
+	UpstreamResponses.Inc(req.URL.Host, strconv.Itoa(code))
+	return resp, err
+}
+
+// Hit counts a lookup in the named cache.
+func Hit(cache string, hit bool) {
+	if hit {
+		CacheLookups.Inc(cache, "hit")
+	} else {
+		CacheLookups.Inc(cache, "miss")
+	}
+}
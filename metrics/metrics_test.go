@@ -0,0 +1,22 @@
+package metrics
+
+import "testing"
+
+func TestQuoteLabel(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"/eti", `"/eti"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\relay`, `"C:\\relay"`},
+		{"two\nlines", `"two\nlines"`},
+		// no Go escapes: the text format doesn't have them
+		{"café", `"café"`},
+		{"tab\there", "\"tab\there\""},
+	}
+	for _, test := range tests {
+		if got := quoteLabel(test.value); got != test.want {
+			t.Errorf("quoteLabel(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/guregu/bbs"
+)
+
+// at most this many origins get their own bbs server,
+// so a proxy passing along junk Host headers can't make us grow forever
+const maxOrigins = 16
+
+// the most of an HTTP command we'll read to see whose session it's for
+const maxCommandSize = 1 << 20
+
+// origin is the scheme and host a client reached us at.
+type origin struct {
+	secure bool
+	host   string
+}
+
+func (o origin) ws(path string) string {
+	if o.secure {
+		return "wss://" + o.host + path + "/ws"
+	}
+	return "ws://" + o.host + path + "/ws"
+}
+
+// siteHandler serves a site. Behind trusted proxies, it keeps a bbs server for each origin
+// clients reach us at, so the Hello each client gets has a realtime URL that works for them.
+type siteHandler struct {
+	path string
+	gw   gateway
+	def  *bbs.Server
+
+	mu      sync.Mutex
+	servers map[origin]*bbs.Server
+}
+
+func newSiteHandler(path string, gw gateway) *siteHandler {
+	return &siteHandler{
+		path:    path,
+		gw:      gw,
+		def:     bbs.NewServer(gw.new),
+		servers: make(map[origin]*bbs.Server),
+	}
+}
+
+// server returns the bbs server for whoever made this request.
+func (h *siteHandler) server(r *http.Request) *bbs.Server {
+	o, ok := forwardedOrigin(r)
+	if !ok || h.gw.reach == nil {
+		return h.def
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	srv, ok := h.servers[o]
+	if !ok {
+		if len(h.servers) >= maxOrigins {
+			return h.def
+		}
+		srv = bbs.NewServer(h.gw.reach(o.ws(h.path)))
+		h.servers[o] = srv
+	}
+	return srv
+}
+
+// factory returns the bbs.BBS factory for whoever made this request.
+func (h *siteHandler) factory(r *http.Request) func() bbs.BBS {
+	if o, ok := forwardedOrigin(r); ok && h.gw.reach != nil {
+		return h.gw.reach(o.ws(h.path))
+	}
+	return h.gw.new
+}
+
+// hello is the Hello that whoever made this request would get.
+func (h *siteHandler) hello(r *http.Request) bbs.HelloMessage {
+	return h.factory(r)().Hello()
+}
+
+// health returns an error if the site is in trouble.
+func (h *siteHandler) health() error {
+	if h.gw.health == nil {
+		return nil
+	}
+	return h.gw.health()
+}
+
+func (h *siteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if id := requestID(r); id != "" {
+		if key, ok := peekCommand(h.path, r); ok {
+			defer beginCommand(key, id)()
+		}
+	}
+	h.server(r).ServeHTTP(w, r)
+}
+
+func (h *siteHandler) serveWS(w http.ResponseWriter, r *http.Request) {
+	id := requestID(r)
+	if id == "" {
+		h.server(r).WS.ServeHTTP(w, r)
+		return
+	}
+	// a websocket is one session, so it gets a server of its own that tells the session its request ID
+	new := h.factory(r)
+	bbs.NewServer(func() bbs.BBS {
+		return withRequestID(new(), id)
+	}).WS.ServeHTTP(w, r)
+}
+
+// peekCommand figures out the key an HTTP command's request ID goes under (see beginCommand),
+// leaving the body for bbs to read.
+func peekCommand(site string, r *http.Request) (key string, ok bool) {
+	if r.Body == nil {
+		return "", false
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxCommandSize))
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil {
+		return "", false
+	}
+	var cmd struct {
+		Session  string `json:"session"`
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal(body, &cmd); err != nil {
+		return "", false
+	}
+	return commandKey(site, cmd.Session, cmd.Username), true
+}
+
+// forwardedOrigin figures out where a client reached us from proxy headers,
+// if the request came from a trusted proxy and it's different from our own host.
+func forwardedOrigin(r *http.Request) (origin, bool) {
+	server := currentConfig().Server
+	if !server.trusts(r.RemoteAddr) {
+		return origin{}, false
+	}
+
+	o := origin{secure: server.secure(), host: server.Host}
+	if fwd := r.Header.Get("Forwarded"); fwd != "" {
+		// only the first proxy's opinion matters: it's the one the client talked to
+		first := strings.Split(fwd, ",")[0]
+		for _, pair := range strings.Split(first, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v := strings.Trim(kv[1], `"`)
+			switch strings.ToLower(kv[0]) {
+			case "proto":
+				o.secure = strings.EqualFold(v, "https")
+			case "host":
+				o.host = v
+			}
+		}
+	} else {
+		if proto := firstValue(r.Header.Get("X-Forwarded-Proto")); proto != "" {
+			o.secure = strings.EqualFold(proto, "https")
+		}
+		if host := firstValue(r.Header.Get("X-Forwarded-Host")); host != "" {
+			o.host = host
+		}
+	}
+
+	if o.host == "" || strings.ContainsAny(o.host, "/ \\") {
+		return origin{}, false
+	}
+	if o.host == server.Host && o.secure == server.secure() {
+		// same as usual
+		return origin{}, false
+	}
+	return o, true
+}
+
+func firstValue(header string) string {
+	return strings.TrimSpace(strings.Split(header, ",")[0])
+}
+
+// trusts returns true if addr (ip:port) is one of our trusted proxies.
+func (sc servercfg) trusts(addr string) bool {
+	if len(sc.TrustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range sc.TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestForwardedOrigin(t *testing.T) {
+	defer setConfig(currentConfig())
+	setConfig(config{Server: servercfg{
+		Host:           "relay.example.com",
+		TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"},
+	}})
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    origin
+		ok      bool
+	}{
+		{
+			name:    "Forwarded",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{"Forwarded": `for=1.2.3.4;proto=https;host="bbs.example.org"`},
+			want:    origin{secure: true, host: "bbs.example.org"},
+			ok:      true,
+		},
+		{
+			name:    "only the first proxy counts",
+			remote:  "192.168.1.1:5000",
+			headers: map[string]string{"Forwarded": "host=first.example.org, host=second.example.org"},
+			want:    origin{host: "first.example.org"},
+			ok:      true,
+		},
+		{
+			name:   "X-Forwarded",
+			remote: "10.1.2.3:5000",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "bbs.example.org, inner.example.org",
+			},
+			want: origin{secure: true, host: "bbs.example.org"},
+			ok:   true,
+		},
+		{
+			name:   "Forwarded wins",
+			remote: "10.1.2.3:5000",
+			headers: map[string]string{
+				"Forwarded":        "host=bbs.example.org",
+				"X-Forwarded-Host": "other.example.org",
+			},
+			want: origin{host: "bbs.example.org"},
+			ok:   true,
+		},
+		{
+			name:    "just the scheme changed",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{"X-Forwarded-Proto": "https"},
+			want:    origin{secure: true, host: "relay.example.com"},
+			ok:      true,
+		},
+		{
+			name:    "same as usual",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{"X-Forwarded-Host": "relay.example.com"},
+		},
+		{
+			name:    "untrusted peer",
+			remote:  "203.0.113.5:5000",
+			headers: map[string]string{"Forwarded": "proto=https;host=evil.example.net"},
+		},
+		{
+			name:    "untrusted peer next to a trusted one",
+			remote:  "192.168.1.2:5000",
+			headers: map[string]string{"X-Forwarded-Host": "evil.example.net"},
+		},
+		{
+			name:    "no headers",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{},
+		},
+		{
+			name:    "host with a path",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{"Forwarded": `host="evil.example.net/ws"`},
+		},
+		{
+			name:    "host with a space",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{"X-Forwarded-Host": `"evil.example.net" x`},
+		},
+		{
+			name:    "host with a backslash",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{"X-Forwarded-Host": `evil.example.net\x`},
+		},
+		{
+			name:    "pairs without values",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{"Forwarded": "host;proto"},
+		},
+		{
+			name:    "empty host",
+			remote:  "10.1.2.3:5000",
+			headers: map[string]string{"Forwarded": `host=""`},
+		},
+		{
+			name:    "bad remote address",
+			remote:  "not an address",
+			headers: map[string]string{"X-Forwarded-Host": "bbs.example.org"},
+		},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/eti", nil)
+		r.RemoteAddr = test.remote
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		got, ok := forwardedOrigin(r)
+		if ok != test.ok || got != test.want {
+			t.Errorf("%s: got %+v, %v; want %+v, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestTrusts(t *testing.T) {
+	sc := servercfg{TrustedProxies: []string{"10.0.0.0/8", "::1", "bogus"}}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.20.30.40:80", true},
+		{"10.20.30.40", true},
+		{"[::1]:80", true},
+		{"11.0.0.1:80", false},
+		{"bogus:80", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := sc.trusts(test.addr); got != test.want {
+			t.Errorf("trusts(%q) = %v, want %v", test.addr, got, test.want)
+		}
+	}
+	if (servercfg{}).trusts("10.20.30.40:80") {
+		t.Error("nobody should be trusted without trusted proxies")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/guregu/relay/logger"
+	"github.com/zenazn/goji/graceful"
+)
+
+// handleSignals shuts down gracefully on SIGTERM (as well as Ctrl-C)
+// and reloads the config on SIGHUP.
+func handleSignals() {
+	graceful.AddSignal(syscall.SIGTERM)
+	// websockets never finish on their own, so don't wait for them
+	graceful.PreHook(hangUp)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			<-hup
+			reload()
+		}
+	}()
+}
+
+// reload rereads the config file and swaps in the new config and its sites.
+// Sites whose config hasn't changed keep running as they were, sessions and all.
+// Sites that were removed or replaced are closed.
+// [log] changes right away, but changes to [server], [web] and [cache] need a restart.
+// If anything is wrong with the new config, we keep the old one.
+func reload() {
+	logger.Info("reloading config", "file", *cfgFile)
+	next, err := parseConfig(*cfgFile)
+	if err != nil {
+		logger.Error("couldn't reload config", "file", *cfgFile, "error", err)
+		return
+	}
+	old := currentConfig()
+	if !reflect.DeepEqual(next.Server, old.Server) ||
+		!reflect.DeepEqual(next.Web, old.Web) ||
+		!reflect.DeepEqual(next.Cache, old.Cache) {
+		logger.Warn("ignoring changes to [server], [web] and [cache] until restart", "file", *cfgFile)
+	}
+	next.Server, next.Web, next.Cache = old.Server, old.Web, old.Cache
+
+	if errs := next.validate(); len(errs) > 0 {
+		for _, err := range errs {
+			logger.Error("bad config", "file", *cfgFile, "error", err)
+		}
+		logger.Error("keeping the old config", "file", *cfgFile, "problems", len(errs))
+		return
+	}
+
+	running := make(map[string]relay)
+	for _, r := range sites.current() {
+		running[r.Path] = r
+	}
+	var relays []relay
+	var mounted []relay // new this time
+	for _, sc := range next.sites() {
+		if !sc.Enabled {
+			continue
+		}
+		if r, ok := running[sc.path()]; ok && reflect.DeepEqual(r.cfg, sc) {
+			relays = append(relays, r)
+			delete(running, r.Path)
+			continue
+		}
+		r, err := mount(sc)
+		if err != nil {
+			logger.Error("couldn't set up site, keeping the old config", "backend", sc.Type, "site", sc.path(), "error", err)
+			closeRelays(mounted)
+			return
+		}
+		logger.Info("set up site", "backend", sc.Type, "site", r.Path)
+		relays = append(relays, r)
+		mounted = append(mounted, r)
+	}
+	sites.set(relays)
+	setConfig(next)
+	next.Log.apply()
+	if !usesThreadCache(relays) {
+		stopExpiring()
+	}
+	// what's left was removed or replaced
+	for path, r := range running {
+		closeRelays([]relay{r})
+		logger.Info("stopped serving site", "site", path)
+	}
+	logger.Info("reloaded config", "file", *cfgFile, "sites", len(relays))
+}
+
+// closeRelays closes sites we aren't going to serve anymore.
+func closeRelays(relays []relay) {
+	for _, r := range relays {
+		if r.close != nil {
+			r.close()
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// router sends requests to the sites we're serving.
+// Sites can be swapped out while we're running, when the config is reloaded.
+type router struct {
+	mu       sync.RWMutex
+	relays   []relay
+	routes   map[string]http.Handler // path → handler
+	fallback http.Handler            // for everything else
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mu.RLock()
+	h, ok := rt.routes[r.URL.Path]
+	rt.mu.RUnlock()
+	if !ok {
+		h = rt.fallback
+	}
+	h.ServeHTTP(w, r)
+}
+
+// set replaces the sites we're serving.
+func (rt *router) set(relays []relay) {
+	routes := make(map[string]http.Handler)
+	for _, r := range relays {
+		for path, h := range r.routes {
+			routes[path] = h
+		}
+	}
+	rt.mu.Lock()
+	rt.relays, rt.routes = relays, routes
+	rt.mu.Unlock()
+}
+
+// current returns the sites we're serving right now.
+func (rt *router) current() []relay {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.relays
+}
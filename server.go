@@ -1,90 +1,156 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
-	"log"
 	"net/http"
+	"sync"
 
 	"github.com/guregu/bbs"
 	"github.com/guregu/relay/eti"
 	"github.com/guregu/relay/fourchan"
+	"github.com/guregu/relay/logger"
+	"github.com/guregu/relay/metrics"
 	"github.com/zenazn/goji"
-	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
 )
 
 var cfgFile = flag.String("config", "config.toml", "config file path")
-var cfg config
-var servers []relay
+var sites = &router{fallback: http.NotFoundHandler()}
 
+// relay is a site we're serving.
 type relay struct {
-	server *bbs.Server
-	Path   string `json:"path"`
+	handler *siteHandler
+	Path    string `json:"path"`
+
+	cfg    sitecfg
+	routes map[string]http.Handler // path → handler
+	close  func()                  // from the gateway, can be nil
+}
+
+// the config we're running with, swapped out when it's reloaded
+var (
+	cfgMu     sync.RWMutex
+	activeCfg config
+)
+
+// currentConfig returns the config we're running with right now.
+func currentConfig() config {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	return activeCfg
+}
+
+// setConfig swaps in a new config.
+func setConfig(c config) {
+	cfgMu.Lock()
+	activeCfg = c
+	cfgMu.Unlock()
 }
 
 func main() {
 	flag.Parse()
-	var err error
-	cfg, err = parseConfig(*cfgFile)
+	logger.Configure(logger.Logfmt, logger.InfoLevel)
+	cfg, err := parseConfig(*cfgFile)
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	if cfg.Server.Host == "" {
-		log.Fatalf("No host set in %s", *cfgFile)
+		logger.Fatal("couldn't read config", "file", *cfgFile, "error", err)
 	}
+	cfg.Log.apply()
 
-	if cfg.ETI.Enabled {
-		path := maybe(cfg.ETI.Path, "/bbs")
-		wsPath := ws(path)
-		eti.Setup(cfg.ETI.Name, cfg.ETI.Description, wsPath)
-		if cfg.ETI.Cache && cfg.Cache.Addr != "" {
-			eti.DBConnect(cfg.Cache.Addr, "eti")
+	if errs := cfg.validate(); len(errs) > 0 {
+		for _, err := range errs {
+			logger.Error("bad config", "file", *cfgFile, "error", err)
 		}
-		srv := bbs.NewServer(eti.New)
-		goji.Handle(path, srv)
-		goji.Handle(path+"/ws", srv.WS)
-		servers = append(servers, relay{
-			server: srv,
-			Path:   path,
-		})
+		logger.Fatal("not starting", "file", *cfgFile, "problems", len(errs))
 	}
+	setConfig(cfg)
 
-	if cfg.FourChan.Enabled {
-		path := maybe(cfg.FourChan.Path, "/bbs")
-		wsPath := ws(path)
-		fourchan.Setup(cfg.FourChan.Name, cfg.FourChan.Description, wsPath)
-		// no cache yet. sorry moot
-		srv := bbs.NewServer(fourchan.New)
-		goji.Handle(path, srv)
-		goji.Handle(path+"/ws", srv.WS)
-		servers = append(servers, relay{
-			server: srv,
-			Path:   path,
-		})
+	var relays []relay
+	for _, sc := range cfg.sites() {
+		if !sc.Enabled {
+			continue
+		}
+		r, err := mount(sc)
+		if err != nil {
+			logger.Fatal("couldn't set up site", "backend", sc.Type, "site", sc.path(), "error", err)
+		}
+		relays = append(relays, r)
 	}
+	sites.set(relays)
 
 	if cfg.Web.Index != "" {
-		log.Println(cfg.Web.Index)
 		goji.Get(cfg.Web.Index, indexHandler)
 	}
 
+	goji.Get("/healthz", healthz)
+	goji.Get("/readyz", readyz)
+	goji.Get("/metrics", metrics.Handler())
+
 	if cfg.Web.Root != "" {
-		goji.Get("/*", http.FileServer(http.Dir(cfg.Web.Root)))
+		sites.fallback = http.FileServer(http.Dir(cfg.Web.Root))
 	}
+	goji.Handle("/*", sites)
 
-	goji.Serve()
+	goji.Insert(logRequests, middleware.Logger)
+	goji.Abandon(middleware.Logger)
+	handleSignals()
+	if cfg.Server.secure() {
+		tlsCfg, err := cfg.Server.tlsConfig()
+		if err != nil {
+			logger.Fatal("couldn't set up TLS", "error", err)
+		}
+		goji.ServeTLS(tlsCfg)
+	} else {
+		goji.Serve()
+	}
+
+	// connections have drained
+	eti.Flush()
+	stopExpiring()
+	if threadCache != nil {
+		threadCache.Close()
+	}
+	fourchan.Close()
+	logger.Info("bye")
 }
 
-// for index.json, which lists all our servers
-func indexHandler(c web.C, w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "application/json")
-	data, err := json.Marshal(servers)
-	log.Printf("%s", string(data))
+// mount sets up a site with its backend, ready to serve at its path
+func mount(sc sitecfg) (relay, error) {
+	setup, ok := backends[sc.Type]
+	if !ok {
+		return relay{}, errors.New("unknown site type: " + sc.Type)
+	}
+	path := sc.path()
+	gw, err := setup(sc, ws(path))
 	if err != nil {
-		log.Println(err)
+		return relay{}, err
+	}
+
+	// an explicit realtime URL in the config wins over proxy headers
+	if sc.Hello.RealtimeURL != "" {
+		gw.reach = nil
+	}
+	gw.new = instrument(sc.Type, path, gw.new)
+	if reach := gw.reach; reach != nil {
+		gw.reach = func(realtimeURL string) func() bbs.BBS {
+			return instrument(sc.Type, path, reach(realtimeURL))
+		}
 	}
-	w.Write(data)
+	handler := newSiteHandler(path, gw)
+	r := relay{
+		handler: handler,
+		Path:    path,
+		cfg:     sc,
+		close:   gw.close,
+		routes: map[string]http.Handler{
+			path:         handler,
+			path + "/ws": trackSessions(path+"/ws", http.HandlerFunc(handler.serveWS)),
+		},
+	}
+	for sub, h := range gw.handlers {
+		r.routes[path+sub] = trackSessions(path+sub, h)
+	}
+	return r, nil
 }
 
 func maybe(test, def string) string {
@@ -95,5 +161,10 @@ func maybe(test, def string) string {
 }
 
 func ws(path string) string {
-	return "ws://" + cfg.Server.Host + path + "/ws"
+	server := currentConfig().Server
+	scheme := "ws://"
+	if server.secure() {
+		scheme = "wss://"
+	}
+	return scheme + server.Host + path + "/ws"
 }
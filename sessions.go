@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/guregu/relay/logger"
+)
+
+// websocket connections, which the HTTP server forgets about once they're hijacked,
+// so we can hang up on them when shutting down
+var websockets = struct {
+	sync.Mutex
+	conns map[net.Conn]bool
+}{conns: make(map[net.Conn]bool)}
+
+// trackSessions keeps count of a websocket handler's open connections,
+// and remembers them so hangUp can close them.
+func trackSessions(path string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsSessions.Inc(path)
+		defer wsSessions.Dec(path)
+
+		tw := &trackingWriter{ResponseWriter: w}
+		defer tw.forget()
+		h.ServeHTTP(tw, r)
+	})
+}
+
+// hangUp closes every websocket connection.
+func hangUp() {
+	websockets.Lock()
+	defer websockets.Unlock()
+	if len(websockets.conns) > 0 {
+		logger.Info("closing websockets", "count", len(websockets.conns))
+	}
+	for conn := range websockets.conns {
+		conn.Close()
+	}
+}
+
+// trackingWriter remembers the connection if it's hijacked.
+type trackingWriter struct {
+	http.ResponseWriter
+	conn net.Conn
+}
+
+func (tw *trackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := tw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	tw.conn = conn
+	websockets.Lock()
+	websockets.conns[conn] = true
+	websockets.Unlock()
+	return conn, rw, nil
+}
+
+func (tw *trackingWriter) forget() {
+	if tw.conn == nil {
+		return
+	}
+	websockets.Lock()
+	delete(websockets.conns, tw.conn)
+	websockets.Unlock()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/guregu/bbs"
+	"github.com/guregu/relay/logger"
+	"gopkg.in/mgo.v2"
+)
+
+const cacheDialTimeout = 5 * time.Second
+
+// validate checks the whole config, returning every problem it finds.
+func (cfg config) validate() []error {
+	var errs []error
+	problem := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	// [server]
+	if cfg.Server.Host == "" {
+		problem("no host set in [server]")
+	} else if u, err := url.Parse("http://" + cfg.Server.Host); err != nil || u.Host != cfg.Server.Host {
+		problem("invalid host in [server]: %q (want something like localhost:8000)", cfg.Server.Host)
+	}
+
+	switch {
+	case cfg.Server.SelfSigned && (cfg.Server.Cert != "" || cfg.Server.Key != ""):
+		problem("[server] has both selfsigned and a cert/key, pick one")
+	case (cfg.Server.Cert == "") != (cfg.Server.Key == ""):
+		problem("[server] needs both cert and key for HTTPS")
+	case cfg.Server.Cert != "":
+		if _, err := cfg.Server.tlsConfig(); err != nil {
+			problem("can't load certificate: %v", err)
+		}
+	}
+
+	for _, proxy := range cfg.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			problem("invalid trusted proxy in [server]: %q (want an IP or CIDR)", proxy)
+		}
+	}
+
+	// sites
+	paths := make(map[string]string) // path → who's using it
+	for _, p := range monitoringPaths {
+		paths[p] = "monitoring"
+	}
+	if cfg.Web.Index != "" {
+		if other, dup := paths[cfg.Web.Index]; dup {
+			problem("[web] index: path %s is already used by %s", cfg.Web.Index, other)
+		}
+		paths[cfg.Web.Index] = "[web] index"
+	}
+	needCache := false
+	for i, sc := range cfg.sites() {
+		if !sc.Enabled {
+			continue
+		}
+		name := fmt.Sprintf("site #%d (%s)", i+1, maybe(sc.Type, "no type"))
+		if _, ok := backends[sc.Type]; !ok {
+			problem("%s: unknown type %q", name, sc.Type)
+		}
+
+		sitePath := sc.path()
+		if !strings.HasPrefix(sitePath, "/") {
+			problem("%s: path must start with /: %q", name, sitePath)
+		}
+		if other, dup := paths[sitePath]; dup {
+			problem("%s: path %s is already used by %s", name, sitePath, other)
+		} else {
+			paths[sitePath] = name
+		}
+
+		if r := sc.Hello.DefaultRange; r != nil && (len(r) != 2 || !(bbs.Range{Start: r[0], End: r[1]}).Validate()) {
+			problem("%s: hello default_range should be [start, end]: %v", name, r)
+		}
+
+		for _, tags := range []struct {
+			name     string
+			patterns []string
+		}{{"danger_tags", sc.DangerTags}, {"shared_tags", sc.SharedTags}} {
+			for _, pattern := range tags.patterns {
+				// matched like eti's matchTag does
+				if _, err := path.Match(pattern, ""); err != nil {
+					problem("%s: bad pattern in %s: %q", name, tags.name, pattern)
+				}
+			}
+		}
+
+		if sc.Cache {
+			needCache = true
+			if sc.Type == "eti" && cfg.Cache.kind() == "" {
+				problem("%s: cache is on, but [cache] isn't set up", name)
+			}
+		}
+	}
+
+	// [web]
+	if cfg.Web.Root != "" {
+		if fi, err := os.Stat(cfg.Web.Root); err != nil {
+			problem("can't read web root: %v", err)
+		} else if !fi.IsDir() {
+			problem("web root isn't a directory: %s", cfg.Web.Root)
+		} else if f, err := os.Open(cfg.Web.Root); err != nil {
+			problem("can't read web root: %v", err)
+		} else {
+			f.Close()
+		}
+	}
+
+	// [cache]
+	switch cfg.Cache.kind() {
+	case "", "memory":
+	case "mongo":
+		if cfg.Cache.Addr == "" {
+			problem("[cache]: mongo needs an addr")
+		} else if needCache && threadCache == nil {
+			// (if it's already open, it's not going anywhere)
+			if sesh, err := mgo.DialWithTimeout(cfg.Cache.Addr, cacheDialTimeout); err != nil {
+				problem("can't connect to cache at %s: %v", cfg.Cache.Addr, err)
+			} else {
+				sesh.Close()
+			}
+		}
+	case "bolt":
+		if cfg.Cache.Path == "" {
+			problem("[cache]: bolt needs a path")
+		} else if fi, err := os.Stat(filepath.Dir(cfg.Cache.Path)); err != nil || !fi.IsDir() {
+			problem("[cache]: no directory for %s", cfg.Cache.Path)
+		}
+	default:
+		problem("[cache]: unknown type %q (want mongo, bolt or memory)", cfg.Cache.Type)
+	}
+	if cfg.Cache.Size < 0 {
+		problem("[cache]: size can't be negative: %d", cfg.Cache.Size)
+	}
+	ttls := []struct{ name, value string }{
+		{"metadata", cfg.Cache.TTL.Metadata},
+		{"messages", cfg.Cache.TTL.Messages},
+	}
+	for _, ttl := range ttls {
+		if ttl.value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(ttl.value); err != nil || d < 0 {
+			problem("[cache.ttl]: %s should be a duration like \"10m\": %q", ttl.name, ttl.value)
+		}
+	}
+	if cfg.Cache.Expire != "" {
+		if d, err := time.ParseDuration(cfg.Cache.Expire); err != nil || d <= 0 {
+			problem("[cache]: expire should be a duration like \"720h\": %q", cfg.Cache.Expire)
+		}
+	}
+
+	// [log]
+	if _, err := logger.ParseFormat(cfg.Log.Format); err != nil {
+		problem("[log]: %v (want logfmt or json)", err)
+	}
+	if _, err := logger.ParseLevel(cfg.Log.Level); err != nil {
+		problem("[log]: %v (want debug, info, warn or error)", err)
+	}
+
+	return errs
+}